@@ -1,82 +1,128 @@
 package cmd
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 
 	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/manifest"
+	"github.com/rogeecn/sing-box-deploy/internal/ports"
+	"github.com/rogeecn/sing-box-deploy/internal/prompt"
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
 	"github.com/rogeecn/sing-box-deploy/internal/spec"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
 	"github.com/spf13/cobra"
 )
 
 var (
+	deployDomain  string
 	deployEmail   string
 	deployTypes   []string
-	deployRootDir string
 	deployCaddy   string
 	deploySubDir  string
-	deployBinPath string
 	deployProfile string
+	deploySkipVal bool
+
+	deployPorts        map[string]int
+	deployPortRange    string
+	deployExcludePorts []int
+
+	deployEarlyData       int
+	deployEarlyDataHeader string
+
+	deployRouteFinal     string
+	deploySniff          bool
+	deployBlockPrivate   bool
+	deployBlockProtocols []string
+	deployBlockGeosite   []string
+	deployBlockGeoIP     []string
+	deployRuleSetDetour  string
+
+	deployDNS         string
+	deployDNSStrategy string
+	deployStats       []string
+
+	deployLogLevel     string
+	deployLogOutput    string
+	deployLogTimestamp bool
+	deployLogRotate    int
+
+	deployFile       string
+	deployTLSMode    string
+	deployProxy      string
+	deploySubFormats []string
 )
 
 var deployCmd = &cobra.Command{
 	Use:   "deploy <domain>",
 	Short: "Render sing-box + Caddy configs for the given domain",
-	Args:  cobra.ExactArgs(1),
+	Args:  cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		domain := strings.ToLower(strings.TrimSpace(args[0]))
-		if domain == "" {
-			return fmt.Errorf("domain is required")
+		base, err := baseDeployOptions()
+		if err != nil {
+			return err
 		}
-		rootDir := deployRootDir
-		if rootDir == "" {
-			rootDir = "/etc/sing-box"
+		if deployFile != "" {
+			if len(args) > 0 || deployDomain != "" {
+				return fmt.Errorf("a domain cannot be combined with --file")
+			}
+			return deployManifest(cmd, base)
 		}
-		subDir := deploySubDir
-		if subDir == "" {
-			subDir = filepath.Join(rootDir, "subscriptions")
+
+		domain, err := domainArg(args, deployDomain)
+		if err != nil {
+			return err
 		}
-		caddyFile := deployCaddy
-		if caddyFile == "" {
-			caddyFile = "/etc/caddy/Caddyfile"
+		selectedTypes, err := selectInboundTypes()
+		if err != nil {
+			return err
 		}
-
-		selectedTypes := deployTypes
-		if len(selectedTypes) == 0 {
-			choices, err := promptInboundSelection(cmd)
-			if err != nil {
-				return err
-			}
-			selectedTypes = choices
+		pinned := make(map[string]int, len(deployPorts))
+		for key, port := range deployPorts {
+			pinned[strings.ToLower(strings.TrimSpace(key))] = port
 		}
 
 		email := strings.TrimSpace(deployEmail)
 		if email == "" {
 			email = fmt.Sprintf("info@%s", domain)
 		}
-		opts := deployer.Options{
-			Domain:          domain,
-			Email:           email,
-			InboundKeys:     selectedTypes,
-			ProfileName:     deployProfile,
-			RootDir:         rootDir,
-			CaddyFile:       caddyFile,
-			SubscriptionDir: subDir,
-			StateFile:       getStatePath(),
-			SingBoxBinary:   deployBinPath,
+		opts := base
+		opts.Domain = domain
+		opts.Email = email
+		opts.InboundKeys = selectedTypes
+		opts.ProfileName = deployProfile
+		opts.PinnedPorts = pinned
+		opts.TLSMode = deployTLSMode
+		opts.Proxy = deployProxy
+		opts.SubscriptionFormats = deploySubFormats
+		opts.Routing = routingFromFlags(cmd)
+		if opts.DNS, err = dnsFromFlags(cmd); err != nil {
+			return err
 		}
+		if opts.Stats, err = statsFromFlags(cmd); err != nil {
+			return err
+		}
+		opts.Log = logFromFlags(cmd)
 		st, err := deployer.Run(opts)
 		if err != nil {
 			return err
 		}
+		if structuredOutput() {
+			if err := applyServices(cmd, st.RootDir, st.CaddyFile); err != nil {
+				return err
+			}
+			return writeOutput(cmd, newDeployOutput([]*state.Deployment{st}, nil))
+		}
 		cmd.Printf("Deployed %d inbounds for %s\n", len(st.Inbounds), st.Domain)
 		cmd.Printf("sing-box config: %s\n", fmt.Sprintf("%s/00_common.json", st.RootDir))
 		cmd.Printf("Caddyfile: %s\n", st.CaddyFile)
 		cmd.Printf("Subscriptions: %s\n", st.SubscriptionFile)
+		if err := applyServices(cmd, st.RootDir, st.CaddyFile); err != nil {
+			return err
+		}
 
 		keySet := make(map[string]struct{}, len(selectedTypes))
 		for _, k := range selectedTypes {
@@ -97,64 +143,248 @@ var deployCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(deployCmd)
+	deployCmd.Flags().
+		StringVarP(&deployFile, "file", "f", "", "converge the host to a deployment manifest (YAML or JSON)")
+	deployCmd.Flags().StringVar(&deployDomain, "domain", "", "domain to deploy (alternative to the positional argument)")
 	deployCmd.Flags().StringVar(&deployEmail, "email", "", "email used for TLS certificate registration")
-	deployCmd.Flags().StringSliceVar(&deployTypes, "type", nil, "inbound types to enable (repeatable)")
+	deployCmd.Flags().StringSliceVar(&deployTypes, "type", nil, "inbound types to enable (repeatable, \"all\" for every type; prompts when omitted on a terminal)")
 	deployCmd.Flags().StringVar(&deployProfile, "name", "", "profile name shown in share links (defaults to domain)")
-	deployCmd.Flags().StringVar(&deployRootDir, "root", "", "sing-box root directory (default /etc/sing-box)")
 	deployCmd.Flags().StringVar(&deployCaddy, "caddy", "", "Caddyfile output path (default /etc/caddy/Caddyfile)")
 	deployCmd.Flags().
 		StringVar(&deploySubDir, "subscriptions", "", "directory for subscription files (default <root>/subscriptions)")
+	deployCmd.Flags().StringVar(&deployTLSMode, "tls-mode", "", "certificate source: acme (default) or internal")
+	deployCmd.Flags().StringVar(&deployProxy, "proxy", "", "front proxy: caddy (default) or none")
+	deployCmd.Flags().
+		StringSliceVar(&deploySubFormats, "subscription-format", nil, "subscription formats to write: text, base64, clash, sing-box (repeatable)")
+	deployCmd.Flags().StringVar(&deployRouteFinal, "route-final", "", "outbound for traffic no rule matches (default direct)")
+	deployCmd.Flags().BoolVar(&deploySniff, "sniff", false, "sniff protocols and domains of proxied connections")
+	deployCmd.Flags().BoolVar(&deployBlockPrivate, "block-private", false, "reject connections to private and loopback addresses")
+	deployCmd.Flags().
+		StringSliceVar(&deployBlockProtocols, "block-protocol", nil, "reject sniffed protocols, e.g. bittorrent (repeatable)")
+	deployCmd.Flags().
+		StringSliceVar(&deployBlockGeosite, "block-geosite", nil, "reject domains of a geosite rule-set, e.g. category-ads-all (repeatable)")
+	deployCmd.Flags().StringSliceVar(&deployBlockGeoIP, "block-geoip", nil, "reject addresses of a geoip rule-set (repeatable)")
+	deployCmd.Flags().StringVar(&deployRuleSetDetour, "rule-set-detour", "", "outbound used to download remote rule-sets (default direct)")
+	deployCmd.Flags().StringVar(&deployDNS, "dns", "", fmt.Sprintf(
+		"server DNS preset: %s, or none for the system resolver", strings.Join(singbox.DNSPresetNames(), ", ")))
+	deployCmd.Flags().
+		StringVar(&deployDNSStrategy, "dns-strategy", "prefer_ipv4", "DNS domain strategy: prefer_ipv4, prefer_ipv6, ipv4_only or ipv6_only")
+	deployCmd.Flags().StringSliceVar(&deployStats, "stats", nil,
+		"enable traffic statistics APIs on loopback: clash, v2ray (repeatable), or none")
+	deployCmd.Flags().StringVar(&deployLogLevel, "log-level", "", "sing-box log level: trace, debug, info (default), warn, error, fatal or panic")
+	deployCmd.Flags().StringVar(&deployLogOutput, "log-output", "", fmt.Sprintf(
+		"sing-box log file, or journald to log to the systemd journal (default %s)", singbox.DefaultLogFile))
+	deployCmd.Flags().
+		BoolVar(&deployLogTimestamp, "log-timestamp", false, "prefix log entries with the time (default true, false for journald)")
+	deployCmd.Flags().IntVar(&deployLogRotate, "log-rotate", 7, "daily rotated log files kept by logrotate")
+	deployCmd.Flags().StringToIntVar(&deployPorts, "port", nil, "pin the listen port of an inbound, e.g. vless-ws-tls=30001 (repeatable)")
+	deployCmd.Flags().
+		StringVar(&deployPortRange, "port-range", ports.DefaultRange.String(), "range for randomly allocated listen ports")
+	deployCmd.Flags().IntSliceVar(&deployExcludePorts, "exclude-port", nil, "ports never allocated to inbounds (repeatable)")
+	addServiceFlags(deployCmd)
 	deployCmd.Flags().
-		StringVar(&deployBinPath, "sing-box-bin", "sing-box", "path to sing-box binary for helper commands")
+		BoolVar(&deploySkipVal, "skip-validate", false, "promote files without running sing-box check and caddy validate")
+	deployCmd.Flags().
+		IntVar(&deployEarlyData, "ws-early-data", spec.DefaultMaxEarlyData, "max early data bytes for WebSocket inbounds (0 disables)")
+	deployCmd.Flags().
+		StringVar(&deployEarlyDataHeader, "ws-early-data-header", spec.DefaultEarlyDataHeaderName, "header carrying WebSocket early data")
 }
 
-func promptInboundSelection(cmd *cobra.Command) ([]string, error) {
-	supported := spec.SupportedKeys()
-	sort.Strings(supported)
-	out := cmd.OutOrStdout()
-	fmt.Fprintln(out, "Available inbound templates:")
-	for i, key := range supported {
-		fmt.Fprintf(out, "  %d) %s\n", i+1, key)
+// routingFromFlags builds the routing section from the routing flags. It
+// returns nil when none was given so the recorded routing is kept; otherwise
+// the flags replace it.
+func routingFromFlags(cmd *cobra.Command) *singbox.Routing {
+	changed := false
+	for _, name := range []string{"route-final", "sniff", "block-private", "block-protocol", "block-geosite", "block-geoip", "rule-set-detour"} {
+		changed = changed || cmd.Flags().Changed(name)
+	}
+	if !changed {
+		return nil
+	}
+	routing := &singbox.Routing{
+		Final:          deployRouteFinal,
+		Sniff:          deploySniff,
+		BlockPrivate:   deployBlockPrivate,
+		DownloadDetour: deployRuleSetDetour,
+	}
+	if len(deployBlockProtocols) > 0 {
+		routing.Rules = append(routing.Rules, singbox.Rule{Protocol: deployBlockProtocols, Outbound: singbox.OutboundBlock})
+	}
+	if len(deployBlockGeosite) > 0 {
+		routing.Rules = append(routing.Rules, singbox.Rule{Geosite: deployBlockGeosite, Outbound: singbox.OutboundBlock})
+	}
+	if len(deployBlockGeoIP) > 0 {
+		routing.Rules = append(routing.Rules, singbox.Rule{GeoIP: deployBlockGeoIP, Outbound: singbox.OutboundBlock})
 	}
-	fmt.Fprint(out, "请选择需要部署的协议编号(可用逗号分隔，默认全部): ")
+	return routing
+}
 
-	reader := bufio.NewReader(cmd.InOrStdin())
-	line, err := reader.ReadString('\n')
-	if err != nil && err.Error() != "EOF" {
-		return nil, err
+// dnsFromFlags builds the dns section from --dns. It returns nil when the
+// flag was not given so the recorded DNS settings are kept.
+func dnsFromFlags(cmd *cobra.Command) (*singbox.DNS, error) {
+	if !cmd.Flags().Changed("dns") {
+		if cmd.Flags().Changed("dns-strategy") {
+			return nil, fmt.Errorf("--dns-strategy requires --dns")
+		}
+		return nil, nil
+	}
+	preset := strings.ToLower(strings.TrimSpace(deployDNS))
+	if preset == "none" {
+		return &singbox.DNS{}, nil
 	}
-	line = strings.TrimSpace(line)
-	if line == "" || strings.EqualFold(line, "all") {
-		return supported, nil
+	if _, ok := singbox.DNSPresets[preset]; !ok {
+		return nil, fmt.Errorf("unknown DNS preset %q (want one of %s, none)", deployDNS, strings.Join(singbox.DNSPresetNames(), ", "))
 	}
+	return &singbox.DNS{Preset: preset, Strategy: deployDNSStrategy}, nil
+}
 
-	separators := []rune{',', '，', ' ', '\t', ';'}
-	tokens := strings.FieldsFunc(line, func(r rune) bool {
-		for _, sep := range separators {
-			if r == sep {
-				return true
-			}
+// statsFromFlags builds the experimental API settings from --stats. It
+// returns nil when the flag was not given so the recorded settings are kept.
+func statsFromFlags(cmd *cobra.Command) (*singbox.Stats, error) {
+	if !cmd.Flags().Changed("stats") {
+		return nil, nil
+	}
+	stats := &singbox.Stats{}
+	for _, api := range deployStats {
+		switch strings.ToLower(strings.TrimSpace(api)) {
+		case "clash":
+			stats.ClashAPI = singbox.DefaultClashAPI
+		case "v2ray":
+			stats.V2RayAPI = singbox.DefaultV2RayAPI
+		case "none":
+		default:
+			return nil, fmt.Errorf("unknown stats API %q (want clash, v2ray or none)", api)
 		}
-		return false
-	})
-	if len(tokens) == 0 {
-		return nil, fmt.Errorf("未选择任何协议")
 	}
-	indices := make(map[int]struct{})
-	var selected []string
-	for _, token := range tokens {
-		idx, err := strconv.Atoi(token)
-		if err != nil {
-			return nil, fmt.Errorf("无效编号: %s", token)
+	return stats, nil
+}
+
+// logFromFlags builds the log section from the --log-* flags. It returns
+// nil when none was given so the recorded settings are kept; otherwise the
+// flags replace them.
+func logFromFlags(cmd *cobra.Command) *singbox.Log {
+	changed := false
+	for _, name := range []string{"log-level", "log-output", "log-timestamp", "log-rotate"} {
+		changed = changed || cmd.Flags().Changed(name)
+	}
+	if !changed {
+		return nil
+	}
+	log := &singbox.Log{Level: deployLogLevel, Output: deployLogOutput}
+	if cmd.Flags().Changed("log-timestamp") {
+		log.Timestamp = &deployLogTimestamp
+	}
+	if cmd.Flags().Changed("log-rotate") {
+		log.Rotate = deployLogRotate
+	}
+	return log
+}
+
+// baseDeployOptions collects the host-wide deploy flags shared by single
+// domain and manifest deploys.
+func baseDeployOptions() (deployer.Options, error) {
+	rootDir := getRootDir()
+	subDir := deploySubDir
+	if subDir == "" {
+		subDir = filepath.Join(rootDir, "subscriptions")
+	}
+	caddyFile := deployCaddy
+	if caddyFile == "" {
+		caddyFile = "/etc/caddy/Caddyfile"
+	}
+	portRange, err := ports.ParseRange(deployPortRange)
+	if err != nil {
+		return deployer.Options{}, err
+	}
+	opts := deployer.Options{
+		RootDir:         rootDir,
+		CaddyFile:       caddyFile,
+		SubscriptionDir: subDir,
+		StateFile:       getStatePath(),
+		SingBoxBinary:   singBoxBin,
+		CaddyBinary:     caddyBin,
+		SkipValidate:    deploySkipVal,
+		WaitLock:        waitLock,
+		PortRange:       portRange,
+		ExcludePorts:    deployExcludePorts,
+
+		MaxEarlyData:        deployEarlyData,
+		EarlyDataHeaderName: deployEarlyDataHeader,
+	}
+	return opts, onHost(&opts)
+}
+
+// deployManifest converges state to the manifest: every listed domain is
+// deployed, keeping generated values it already has, and domains missing
+// from the manifest are removed.
+func deployManifest(cmd *cobra.Command, base deployer.Options) error {
+	m, err := manifest.Load(deployFile)
+	if err != nil {
+		return err
+	}
+	deployed, removed, convergeErr := m.Converge(base, func(dep *state.Deployment, removed bool) {
+		if structuredOutput() {
+			return
 		}
-		if idx < 1 || idx > len(supported) {
-			return nil, fmt.Errorf("编号超出范围: %d", idx)
+		if removed {
+			cmd.Printf("Removed %d inbounds for %s\n", len(dep.Inbounds), dep.Domain)
+		} else {
+			cmd.Printf("Deployed %d inbounds for %s\n", len(dep.Inbounds), dep.Domain)
 		}
-		if _, ok := indices[idx]; ok {
-			continue
+	})
+	// The sites converged before a failing one are committed, so the
+	// services still pick them up before the error returns.
+	if convergeErr != nil && len(deployed) == 0 && len(removed) == 0 {
+		return convergeErr
+	}
+	if !structuredOutput() {
+		cmd.Printf("Caddyfile: %s\n", base.CaddyFile)
+		cmd.Printf("Subscriptions: %s\n", base.SubscriptionDir)
+	}
+	if err := applyServices(cmd, base.RootDir, base.CaddyFile); err != nil {
+		return errors.Join(convergeErr, err)
+	}
+	if structuredOutput() {
+		if err := writeOutput(cmd, newDeployOutput(deployed, removed)); err != nil {
+			return err
 		}
-		indices[idx] = struct{}{}
-		selected = append(selected, supported[idx-1])
 	}
-	return selected, nil
+	return convergeErr
+}
+
+// deployOutput is the structured result of deploy.
+type deployOutput struct {
+	Version     int              `json:"version" yaml:"version"`
+	StateFile   string           `json:"state_file" yaml:"state_file"`
+	Deployments []deploymentView `json:"deployments" yaml:"deployments"`
+	Removed     []string         `json:"removed" yaml:"removed"`
+}
+
+func newDeployOutput(deployed []*state.Deployment, removed []string) deployOutput {
+	out := deployOutput{
+		Version:     outputVersion,
+		StateFile:   getStatePath(),
+		Deployments: []deploymentView{},
+		Removed:     []string{},
+	}
+	for _, dep := range deployed {
+		out.Deployments = append(out.Deployments, newDeploymentView(dep))
+	}
+	out.Removed = append(out.Removed, removed...)
+	return out
+}
+
+// selectInboundTypes resolves --type, expanding "all", or asks for the
+// inbound types when none were given.
+func selectInboundTypes() ([]string, error) {
+	if len(deployTypes) > 0 {
+		return spec.NormalizeKeys(deployTypes)
+	}
+	supported := spec.SupportedKeys()
+	sort.Strings(supported)
+	selected, err := prompter.Select("Available inbound templates:", "请选择需要部署的协议编号(可用逗号分隔，默认全部)", supported)
+	if errors.Is(err, prompt.ErrNonInteractive) || errors.Is(err, prompt.ErrNoInput) {
+		return nil, fmt.Errorf("%w: pass --type <key> (repeatable) or --type all to select inbound types", prompt.ErrNonInteractive)
+	}
+	return selected, err
 }
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rogeecn/sing-box-deploy/internal/prompt"
+	"github.com/rogeecn/sing-box-deploy/internal/spec"
+)
+
+func TestSelectInboundTypes(t *testing.T) {
+	all := spec.SupportedKeys()
+	sort.Strings(all)
+	tests := []struct {
+		name     string
+		types    []string
+		prompter prompt.Prompter
+		want     []string
+		wantErr  error
+	}{
+		{name: "type all", types: []string{"all"}, prompter: prompt.Unattended{}, want: all},
+		{name: "type all among others", types: []string{"vless-ws-tls", "ALL"}, prompter: prompt.Unattended{}, want: all},
+		{name: "explicit types", types: []string{"vmess-h2-tls", "vless-ws-tls", "vmess-h2-tls"}, prompter: prompt.Unattended{},
+			want: []string{"vmess-h2-tls", "vless-ws-tls"}},
+		{name: "unattended without types", prompter: prompt.Unattended{AssumeYes: true}, wantErr: prompt.ErrNonInteractive},
+		{name: "answered", prompter: prompt.NewTerminal(strings.NewReader("2,1\n"), io.Discard), want: []string{all[1], all[0]}},
+		{name: "empty answer", prompter: prompt.NewTerminal(strings.NewReader("\n"), io.Discard), want: all},
+		{name: "input ends", prompter: prompt.NewTerminal(strings.NewReader(""), io.Discard), wantErr: prompt.ErrNonInteractive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			savedTypes, savedPrompter := deployTypes, prompter
+			t.Cleanup(func() { deployTypes, prompter = savedTypes, savedPrompter })
+			deployTypes, prompter = tt.types, tt.prompter
+
+			got, err := selectInboundTypes()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, %v; want %v", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
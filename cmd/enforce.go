@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/ports"
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/rogeecn/sing-box-deploy/internal/stats"
+	"github.com/spf13/cobra"
+)
+
+var enforceSkipVal bool
+
+// enforceOutput is the structured result of enforce.
+type enforceOutput struct {
+	Version int                   `json:"version" yaml:"version"`
+	Period  string                `json:"period" yaml:"period"`
+	Changes []deployer.UserChange `json:"changes" yaml:"changes"`
+}
+
+var enforceCmd = &cobra.Command{
+	Use:   "enforce",
+	Short: "Disable users over quota or past expiry and re-enable them when allowed",
+	Long: `Check every user's valid_until and monthly quota, leave disabled users out of
+the rendered inbounds and reload sing-box when anything changed. Quotas are
+checked against this calendar month's (UTC) traffic of the user name read
+from the V2Ray API, so users disabled for quota are re-enabled by the first
+run of the next month. Run it regularly, e.g. from cron or a systemd timer.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireLocal(cmd); err != nil {
+			return err
+		}
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		period := stats.PeriodOf(now)
+		var usage func(string) int64
+		if hasQuota(st) {
+			if st.Common.Stats.V2RayAPI == "" {
+				return fmt.Errorf("quotas need per-user counters, deploy with --stats v2ray first")
+			}
+			snap, err := collectStats(cmd)
+			if err != nil {
+				return err
+			}
+			usage = func(name string) int64 {
+				return snap.PeriodUsage(name, period).Total()
+			}
+		}
+		changes, enforceErr := deployer.Enforce(deployer.Options{
+			StateFile:     getStatePath(),
+			SingBoxBinary: singBoxBin,
+			CaddyBinary:   caddyBin,
+			SkipValidate:  enforceSkipVal,
+			WaitLock:      waitLock,
+			PortRange:     ports.DefaultRange,
+		}, usage, now)
+		// A failing domain leaves the domains before it committed: reload
+		// and report those before returning the error.
+		if enforceErr != nil && len(changes) == 0 {
+			return enforceErr
+		}
+		if len(changes) > 0 && !serviceSkip {
+			if err := (&service.Manager{}).ReloadSingBox(cmd.Context()); err != nil {
+				return errors.Join(enforceErr, err)
+			}
+		}
+		if structuredOutput() {
+			out := enforceOutput{Version: outputVersion, Period: period, Changes: changes}
+			if out.Changes == nil {
+				out.Changes = []deployer.UserChange{}
+			}
+			if err := writeOutput(cmd, out); err != nil {
+				return err
+			}
+			return enforceErr
+		}
+		if len(changes) == 0 {
+			cmd.Println("No changes")
+			return nil
+		}
+		for _, c := range changes {
+			if c.Reason == "" {
+				cmd.Printf("%s %s: enabled %s\n", c.Domain, c.Tag, c.User)
+			} else {
+				cmd.Printf("%s %s: disabled %s (%s)\n", c.Domain, c.Tag, c.User, c.Reason)
+			}
+		}
+		if !serviceSkip {
+			cmd.Printf("Reloaded %s\n", service.SingBoxUnit)
+		}
+		return enforceErr
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(enforceCmd)
+	addStatsFileFlag(enforceCmd)
+	enforceCmd.Flags().BoolVar(&serviceSkip, "no-service", false, "do not reload sing-box")
+	enforceCmd.Flags().
+		BoolVar(&enforceSkipVal, "skip-validate", false, "promote files without running sing-box check and caddy validate")
+}
+
+// hasQuota reports whether any user in st has a quota.
+func hasQuota(st *state.State) bool {
+	for _, dep := range st.Deployments {
+		for _, inbound := range dep.Inbounds {
+			for _, u := range inbound.Users {
+				if u.Quota > 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
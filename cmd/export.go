@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/rogeecn/sing-box-deploy/internal/manifest"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportFile   string
+	exportFormat string
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the current deployments",
+}
+
+var exportManifestCmd = &cobra.Command{
+	Use:          "manifest",
+	Short:        "Write the current state as a deployment manifest for deploy -f",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		format := exportFormat
+		if format == "" {
+			format = manifest.FormatFromPath(exportFile)
+		}
+		data, err := manifest.FromState(st).Marshal(format)
+		if err != nil {
+			return err
+		}
+		if exportFile == "" || exportFile == "-" {
+			_, err := cmd.OutOrStdout().Write(data)
+			return err
+		}
+		// The manifest carries user UUIDs, so keep it private.
+		if err := txn.WriteFile(exportFile, data, 0o600); err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+		cmd.Printf("Manifest written to %s\n", exportFile)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(exportManifestCmd)
+	exportManifestCmd.Flags().StringVarP(&exportFile, "file", "f", "", "write the manifest to this file instead of stdout")
+	exportManifestCmd.Flags().StringVar(&exportFormat, "format", "", "yaml or json (default from the file extension, else yaml)")
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/health"
+	"github.com/rogeecn/sing-box-deploy/internal/metrics"
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/rogeecn/sing-box-deploy/internal/stats"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exporterListen   string
+	exporterTimeout  time.Duration
+	exporterInsecure bool
+	exporterNoProbe  bool
+)
+
+var exporterCmd = &cobra.Command{
+	Use:   "exporter",
+	Short: "Serve Prometheus metrics for the deployments",
+	Long: `Serve /metrics in the Prometheus text format. Every scrape re-reads the state
+file, collects traffic like the stats command (when deploy --stats enabled an
+API) and runs the status probes, which also report the certificate expiry of
+each domain.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireLocal(cmd); err != nil {
+			return err
+		}
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+			families, err := gatherMetrics(r.Context(), cmd)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			metrics.Write(w, families)
+		})
+		srv := &http.Server{Addr: exporterListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		errc := make(chan error, 1)
+		go func() { errc <- srv.ListenAndServe() }()
+		cmd.Printf("Serving metrics on http://%s/metrics\n", exporterListen)
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exporterCmd)
+	addStatsFileFlag(exporterCmd)
+	exporterCmd.Flags().StringVar(&exporterListen, "listen", "127.0.0.1:9469", "address to serve /metrics on")
+	exporterCmd.Flags().DurationVar(&exporterTimeout, "probe-timeout", 5*time.Second, "timeout for each health probe")
+	exporterCmd.Flags().BoolVar(&exporterInsecure, "insecure", false, "skip TLS certificate verification on the public route")
+	exporterCmd.Flags().BoolVar(&exporterNoProbe, "no-probe", false, "do not run health probes or report certificate expiry")
+}
+
+// gatherMetrics builds the metric families for one scrape. Only a missing
+// or unreadable state file fails the scrape; stats and probe failures are
+// reported as metrics.
+func gatherMetrics(ctx context.Context, cmd *cobra.Command) ([]*metrics.Family, error) {
+	st, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		inbounds   = metrics.NewFamily("sing_box_deploy_inbounds", metrics.Gauge, "Inbounds recorded in the state file.")
+		users      = metrics.NewFamily("sing_box_deploy_users", metrics.Gauge, "Users of deployed inbounds; disabled is the reason set by enforce.")
+		lastDeploy = metrics.NewFamily("sing_box_deploy_last_deploy_timestamp_seconds", metrics.Gauge, "Time of the last deploy of a domain.")
+		statsUp    = metrics.NewFamily("sing_box_deploy_stats_up", metrics.Gauge, "Whether the last query of the sing-box stats APIs succeeded.")
+		total      = metrics.NewFamily("sing_box_deploy_traffic_bytes_total", metrics.Counter, "Traffic through sing-box.")
+		inTraffic  = metrics.NewFamily("sing_box_deploy_inbound_traffic_bytes_total", metrics.Counter, "Traffic per inbound.")
+		userTraf   = metrics.NewFamily("sing_box_deploy_user_traffic_bytes_total", metrics.Counter, "Traffic per user name.")
+		period     = metrics.NewFamily("sing_box_deploy_user_period_traffic_bytes", metrics.Gauge, "Traffic per user name in the current quota period.")
+		conns      = metrics.NewFamily("sing_box_deploy_inbound_connections", metrics.Gauge, "Active connections per inbound.")
+		svc        = metrics.NewFamily("sing_box_deploy_service_active", metrics.Gauge, "Whether a systemd unit is active.")
+		probeUp    = metrics.NewFamily("sing_box_deploy_probe_success", metrics.Gauge, "Whether a health probe of an inbound succeeded.")
+		probeTime  = metrics.NewFamily("sing_box_deploy_probe_duration_seconds", metrics.Gauge, "Duration of a health probe of an inbound.")
+		certExpiry = metrics.NewFamily("sing_box_deploy_cert_expiry_seconds", metrics.Gauge, "Seconds until the certificate presented for a domain expires.")
+	)
+	families := []*metrics.Family{inbounds, users, lastDeploy, statsUp, total, inTraffic, userTraf, period, conns, svc, probeUp, probeTime, certExpiry}
+
+	deployments, err := st.Select("")
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range deployments {
+		lastDeploy.Add(float64(dep.LastUpdated.Unix()), "domain", dep.Domain)
+		type key struct{ protocol, transport string }
+		counts := map[key]int{}
+		var order []key
+		for _, inbound := range dep.Inbounds {
+			k := key{inbound.Protocol, inbound.Transport}
+			if counts[k] == 0 {
+				order = append(order, k)
+			}
+			counts[k]++
+			byReason := map[string]int{}
+			for _, u := range inbound.Users {
+				byReason[u.Disabled]++
+			}
+			for _, reason := range []string{"", deployer.DisabledQuota, deployer.DisabledExpired} {
+				if n, ok := byReason[reason]; ok {
+					users.Add(float64(n), "domain", dep.Domain, "tag", inbound.Tag, "disabled", reason)
+				}
+			}
+		}
+		for _, k := range order {
+			inbounds.Add(float64(counts[k]), "domain", dep.Domain, "protocol", k.protocol, "transport", k.transport)
+		}
+	}
+
+	if st.Common.Stats.ClashAPI != "" || st.Common.Stats.V2RayAPI != "" {
+		collector := &stats.Collector{API: st.Common.Stats, Path: getStatsPath(), Wait: true}
+		snap, err := collector.Collect(ctx)
+		up := 1.0
+		if err != nil {
+			cmd.Printf("stats: %v\n", err)
+			up = 0
+			// Still report the totals collected so far.
+			f, loadErr := stats.Load(getStatsPath())
+			if loadErr != nil {
+				return nil, loadErr
+			}
+			snap = &stats.Snapshot{File: f}
+		}
+		statsUp.Add(up)
+		addTraffic(total, snap.Total)
+		for _, name := range stats.Names(snap.Inbounds) {
+			addTraffic(inTraffic, snap.Inbounds[name], "tag", name)
+		}
+		for _, name := range stats.Names(snap.Users) {
+			addTraffic(userTraf, snap.Users[name], "user", name)
+		}
+		current := stats.PeriodOf(time.Now())
+		for _, name := range stats.Names(snap.PeriodUsers) {
+			addTraffic(period, snap.PeriodUsage(name, current), "user", name, "period", current)
+		}
+		for _, name := range sortedKeys(snap.Connections) {
+			conns.Add(float64(snap.Connections[name]), "tag", name)
+		}
+	}
+
+	if exporterNoProbe {
+		return families, nil
+	}
+	report := collectStatus(ctx, getStatePath(), deployments, &health.Prober{Timeout: exporterTimeout, Insecure: exporterInsecure}, &service.Manager{})
+	for _, unit := range report.units() {
+		svc.Add(boolValue(report.Services[unit] == "active"), "unit", unit)
+	}
+	seen := map[string]bool{}
+	for _, res := range report.Inbounds {
+		for _, probe := range []struct {
+			name  string
+			check health.Check
+		}{{"local", res.Local}, {"route", res.Route}} {
+			probeUp.Add(boolValue(probe.check.OK), "domain", res.Domain, "tag", res.Tag, "probe", probe.name)
+			probeTime.Add(probe.check.Latency.Seconds(), "domain", res.Domain, "tag", res.Tag, "probe", probe.name)
+		}
+		if res.CertExpires != nil && !seen[res.Domain] {
+			seen[res.Domain] = true
+			certExpiry.Add(time.Until(*res.CertExpires).Seconds(), "domain", res.Domain)
+		}
+	}
+	return families, nil
+}
+
+func addTraffic(f *metrics.Family, t stats.Traffic, labels ...string) {
+	f.Add(float64(t.Upload), slices.Concat(labels, []string{"direction", "upload"})...)
+	f.Add(float64(t.Download), slices.Concat(labels, []string{"direction", "download"})...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
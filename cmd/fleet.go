@@ -0,0 +1,471 @@
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/health"
+	"github.com/rogeecn/sing-box-deploy/internal/inventory"
+	"github.com/rogeecn/sing-box-deploy/internal/ports"
+	"github.com/rogeecn/sing-box-deploy/internal/remote"
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fleetInventory string
+	fleetParallel  int
+	fleetNodes     []string
+	fleetSkipVal   bool
+	fleetTimeout   time.Duration
+	fleetInsecure  bool
+)
+
+var fleetCmd = &cobra.Command{
+	Use:   "fleet",
+	Short: "Deploy one profile to every host of an inventory over SSH",
+	Long: `Manage the hosts listed in an inventory file. Every host deploys the inventory
+profile on its own domain over SSH, like deploy --host, and keeps its own
+local state file. Hosts are handled concurrently, at most --parallel at a
+time; a failing host does not stop the others.`,
+}
+
+var fleetDeployCmd = &cobra.Command{
+	Use:          "deploy",
+	Short:        "Deploy the profile to the hosts and write the merged subscription",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inv, hosts, err := loadFleet()
+		if err != nil {
+			return err
+		}
+		var mu sync.Mutex
+		done := 0
+		results := forEachNode(hosts, func(h inventory.Host) fleetDeployNode {
+			res := deployNode(cmd.Context(), inv, h)
+			if !structuredOutput() {
+				mu.Lock()
+				done++
+				if res.Error != "" {
+					cmd.Printf("[%d/%d] %s: %s\n", done, len(hosts), h.Name, res.Error)
+				} else {
+					cmd.Printf("[%d/%d] %s: deployed %s\n", done, len(hosts), h.Name, h.Domain)
+				}
+				mu.Unlock()
+			}
+			return res
+		})
+		files, err := writeFleetSubscription(inv)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, res := range results {
+			if res.Error != "" {
+				failed++
+			}
+		}
+		if structuredOutput() {
+			if err := writeOutput(cmd, fleetDeployOutput{
+				Version:       outputVersion,
+				Inventory:     fleetInventory,
+				Nodes:         results,
+				Subscriptions: files,
+			}); err != nil {
+				return err
+			}
+		} else {
+			for _, format := range share.Formats {
+				if path, ok := files[format]; ok {
+					cmd.Printf("Merged subscription: %s\n", path)
+				}
+			}
+		}
+		if failed > 0 {
+			return checkError{fmt.Sprintf("%d of %d hosts failed", failed, len(results))}
+		}
+		return nil
+	},
+}
+
+var fleetStatusCmd = &cobra.Command{
+	Use:          "status",
+	Short:        "Check services, listeners and public routes of every host",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, hosts, err := loadFleet()
+		if err != nil {
+			return err
+		}
+		results := forEachNode(hosts, func(h inventory.Host) fleetStatusNode {
+			return statusNode(cmd.Context(), h)
+		})
+		unhealthy := 0
+		for _, res := range results {
+			if !res.Healthy {
+				unhealthy++
+			}
+		}
+		if structuredOutput() {
+			if err := writeOutput(cmd, fleetStatusOutput{
+				Version:   outputVersion,
+				Inventory: fleetInventory,
+				Nodes:     results,
+				Healthy:   unhealthy == 0,
+			}); err != nil {
+				return err
+			}
+		} else {
+			for i, res := range results {
+				if i > 0 {
+					cmd.Println()
+				}
+				cmd.Printf("== %s (%s) ==\n", res.Name, res.Host)
+				if res.Error != "" {
+					cmd.Printf("Error: %s\n", res.Error)
+					continue
+				}
+				printStatus(cmd, res.statusReport)
+			}
+		}
+		if unhealthy > 0 {
+			return checkError{fmt.Sprintf("%d of %d hosts are unhealthy", unhealthy, len(results))}
+		}
+		return nil
+	},
+}
+
+var fleetURLCmd = &cobra.Command{
+	Use:          "url",
+	Short:        "Print the share links of every host with node names",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inv, hosts, err := loadFleet()
+		if err != nil {
+			return err
+		}
+		out := fleetURLOutput{
+			Version:       outputVersion,
+			Inventory:     fleetInventory,
+			Links:         []fleetLink{},
+			Subscriptions: map[string]string{},
+		}
+		for _, h := range hosts {
+			links, err := nodeLinks(h)
+			if err != nil {
+				return fmt.Errorf("%s: %w", h.Name, err)
+			}
+			out.Links = append(out.Links, links...)
+		}
+		for _, format := range inv.Formats() {
+			path := filepath.Join(inv.SubscriptionDir, share.FileName(inv.Name, format))
+			if _, err := os.Stat(path); err == nil {
+				out.Subscriptions[format] = path
+			}
+		}
+		if structuredOutput() {
+			return writeOutput(cmd, out)
+		}
+		if len(out.Links) == 0 {
+			cmd.Println("no deployed nodes, run fleet deploy first")
+			return nil
+		}
+		for _, link := range out.Links {
+			cmd.Printf("%s\n%s\n\n", link.Name, link.ShareURL)
+		}
+		for _, format := range share.Formats {
+			if path, ok := out.Subscriptions[format]; ok {
+				cmd.Printf("Merged subscription: %s\n", path)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fleetCmd)
+	fleetCmd.AddCommand(fleetDeployCmd, fleetStatusCmd, fleetURLCmd)
+	fleetCmd.PersistentFlags().StringVarP(&fleetInventory, "inventory", "i", "", "inventory file (YAML or JSON)")
+	fleetCmd.MarkPersistentFlagRequired("inventory")
+	fleetCmd.PersistentFlags().IntVar(&fleetParallel, "parallel", 4, "number of hosts handled at the same time")
+	fleetCmd.PersistentFlags().StringSliceVar(&fleetNodes, "node", nil, "only handle the node with this name (repeatable)")
+
+	addServiceFlags(fleetDeployCmd)
+	fleetDeployCmd.Flags().
+		BoolVar(&fleetSkipVal, "skip-validate", false, "promote files without running sing-box check and caddy validate")
+	fleetStatusCmd.Flags().DurationVar(&fleetTimeout, "timeout", 5*time.Second, "timeout for each probe")
+	fleetStatusCmd.Flags().BoolVar(&fleetInsecure, "insecure", false, "skip TLS certificate verification on the public route")
+}
+
+// fleetDeployOutput is the structured result of fleet deploy.
+type fleetDeployOutput struct {
+	Version   int               `json:"version" yaml:"version"`
+	Inventory string            `json:"inventory" yaml:"inventory"`
+	Nodes     []fleetDeployNode `json:"nodes" yaml:"nodes"`
+	// Subscriptions maps each format to the merged subscription file.
+	Subscriptions map[string]string `json:"subscriptions" yaml:"subscriptions"`
+}
+
+type fleetDeployNode struct {
+	Name        string           `json:"name" yaml:"name"`
+	Host        string           `json:"host" yaml:"host"`
+	Domain      string           `json:"domain" yaml:"domain"`
+	StateFile   string           `json:"state_file" yaml:"state_file"`
+	Error       string           `json:"error,omitempty" yaml:"error,omitempty"`
+	Deployments []deploymentView `json:"deployments" yaml:"deployments"`
+	Removed     []string         `json:"removed" yaml:"removed"`
+}
+
+// fleetStatusOutput is the structured result of fleet status.
+type fleetStatusOutput struct {
+	Version   int               `json:"version" yaml:"version"`
+	Inventory string            `json:"inventory" yaml:"inventory"`
+	Nodes     []fleetStatusNode `json:"nodes" yaml:"nodes"`
+	Healthy   bool              `json:"healthy" yaml:"healthy"`
+}
+
+type fleetStatusNode struct {
+	Name         string `json:"name" yaml:"name"`
+	Host         string `json:"host" yaml:"host"`
+	Error        string `json:"error,omitempty" yaml:"error,omitempty"`
+	statusReport `yaml:",inline"`
+}
+
+// fleetURLOutput is the structured result of fleet url.
+type fleetURLOutput struct {
+	Version   int         `json:"version" yaml:"version"`
+	Inventory string      `json:"inventory" yaml:"inventory"`
+	Links     []fleetLink `json:"links" yaml:"links"`
+	// Subscriptions maps each format to the merged subscription file, if
+	// fleet deploy wrote it.
+	Subscriptions map[string]string `json:"subscriptions" yaml:"subscriptions"`
+}
+
+type fleetLink struct {
+	Node     string `json:"node" yaml:"node"`
+	Domain   string `json:"domain" yaml:"domain"`
+	Key      string `json:"key" yaml:"key"`
+	Name     string `json:"name" yaml:"name"`
+	ShareURL string `json:"share_url" yaml:"share_url"`
+}
+
+// loadFleet reads --inventory and selects the --node hosts. The hosts
+// replace --host and --state, which would point every host at one target.
+func loadFleet() (*inventory.Inventory, []inventory.Host, error) {
+	if hostTarget != "" || statePath != "" {
+		return nil, nil, usageError{errors.New("--host and --state do not apply to fleet; list the hosts in the inventory")}
+	}
+	if fleetParallel < 1 {
+		return nil, nil, usageError{errors.New("--parallel must be at least 1")}
+	}
+	inv, err := inventory.Load(fleetInventory)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts, err := inv.Select(fleetNodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inv, hosts, nil
+}
+
+// forEachNode runs fn for every host, at most --parallel at a time, and
+// returns the results in inventory order.
+func forEachNode[T any](hosts []inventory.Host, fn func(inventory.Host) T) []T {
+	results := make([]T, len(hosts))
+	sem := make(chan struct{}, fleetParallel)
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = fn(h)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func nodeStatePath(h inventory.Host) (string, error) {
+	if h.State != "" {
+		return h.State, nil
+	}
+	return hostStatePath(h.Host)
+}
+
+func dialNode(h inventory.Host) (*remote.Client, error) {
+	return remote.Dial(remote.Config{Target: h.Host, KeyFiles: sshKeys, KnownHosts: sshKnownHosts})
+}
+
+// deployNode converges h to its manifest and restarts its services.
+func deployNode(ctx context.Context, inv *inventory.Inventory, h inventory.Host) fleetDeployNode {
+	res := fleetDeployNode{
+		Name:        h.Name,
+		Host:        h.Host,
+		Domain:      h.Domain,
+		Deployments: []deploymentView{},
+		Removed:     []string{},
+	}
+	err := func() error {
+		path, err := nodeStatePath(h)
+		if err != nil {
+			return err
+		}
+		res.StateFile = path
+		client, err := dialNode(h)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		root := cmp.Or(h.Root, defaultRootDir)
+		caddyFile := cmp.Or(h.Caddy, "/etc/caddy/Caddyfile")
+		base := deployer.Options{
+			RootDir:         root,
+			CaddyFile:       caddyFile,
+			SubscriptionDir: filepath.Join(root, "subscriptions"),
+			StateFile:       path,
+			SingBoxBinary:   singBoxBin,
+			CaddyBinary:     caddyBin,
+			SkipValidate:    fleetSkipVal,
+			WaitLock:        waitLock,
+			PortRange:       ports.DefaultRange,
+			FS:              client,
+			Runner:          client,
+			Host:            client.Name(),
+		}
+		deployed, removed, convergeErr := inv.Manifest(h).Converge(base, nil)
+		for _, dep := range deployed {
+			res.Deployments = append(res.Deployments, newDeploymentView(dep))
+		}
+		res.Removed = append(res.Removed, removed...)
+		// Sites converged before a failing one are committed and still
+		// need the services applied.
+		if serviceSkip || (convergeErr != nil && len(deployed) == 0 && len(removed) == 0) {
+			return convergeErr
+		}
+		st, err := state.Load(path)
+		if err != nil {
+			return errors.Join(convergeErr, err)
+		}
+		err = newServiceManager(client, client, root, caddyFile, st.Common.Log).Apply(ctx, !serviceNoRestart)
+		return errors.Join(convergeErr, err)
+	}()
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// statusNode checks the services of h and probes its listeners through the
+// SSH connection and its public routes from here.
+func statusNode(ctx context.Context, h inventory.Host) fleetStatusNode {
+	res := fleetStatusNode{Name: h.Name, Host: h.Host}
+	err := func() error {
+		path, err := nodeStatePath(h)
+		if err != nil {
+			return err
+		}
+		st, err := state.Load(path)
+		if err != nil {
+			if errors.Is(err, state.ErrNotFound) {
+				return fmt.Errorf("%w: %s, run fleet deploy first", state.ErrNotFound, path)
+			}
+			return err
+		}
+		deployments, err := st.Select("")
+		if err != nil {
+			return err
+		}
+		client, err := dialNode(h)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		prober := &health.Prober{Timeout: fleetTimeout, Insecure: fleetInsecure, Dial: client.DialContext}
+		res.statusReport = collectStatus(ctx, path, deployments, prober, &service.Manager{Runner: client})
+		return nil
+	}()
+	if err != nil {
+		res.Error = err.Error()
+		res.Healthy = false
+	}
+	return res
+}
+
+// nodeLinks returns the share links recorded for h, named after the node.
+// A host that was never deployed has none.
+func nodeLinks(h inventory.Host) ([]fleetLink, error) {
+	path, err := nodeStatePath(h)
+	if err != nil {
+		return nil, err
+	}
+	st, err := state.Load(path)
+	if errors.Is(err, state.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var links []fleetLink
+	for _, domain := range st.Domains() {
+		dep := st.Deployments[domain]
+		for _, inbound := range dep.Inbounds {
+			links = append(links, fleetLink{
+				Node:     h.Name,
+				Domain:   dep.Domain,
+				Key:      inbound.Key,
+				Name:     share.NodeEntryName(h.Name, inbound.Tag, dep.Domain),
+				ShareURL: inbound.ShareURL,
+			})
+		}
+	}
+	return links, nil
+}
+
+// writeFleetSubscription renders the links of every deployed host into one
+// subscription per profile format, with load-balancing groups over them.
+func writeFleetSubscription(inv *inventory.Inventory) (map[string]string, error) {
+	var entries []share.Entry
+	for _, h := range inv.Hosts {
+		links, err := nodeLinks(h)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", h.Name, err)
+		}
+		for _, link := range links {
+			entries = append(entries, share.Entry{Name: link.Name, Link: link.ShareURL})
+		}
+	}
+	files := map[string]string{}
+	if len(entries) == 0 {
+		return files, nil
+	}
+	tx := txn.New()
+	defer tx.Rollback()
+	if err := tx.MkdirAll(inv.SubscriptionDir, 0o750); err != nil {
+		return nil, err
+	}
+	for _, format := range inv.Formats() {
+		content, err := share.RenderMerged(format, inv.Name, entries, share.Balance{})
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(inv.SubscriptionDir, share.FileName(inv.Name, format))
+		if err := tx.WriteFile(path, content, 0o640); err != nil {
+			return nil, err
+		}
+		files[format] = path
+	}
+	return files, tx.Commit()
+}
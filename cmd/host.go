@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+	"github.com/rogeecn/sing-box-deploy/internal/remote"
+	"github.com/rogeecn/sing-box-deploy/internal/runner"
+	"github.com/spf13/cobra"
+)
+
+var (
+	hostTarget    string
+	sshKeys       []string
+	sshKnownHosts string
+
+	hostClient *remote.Client
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&hostTarget, "host", "",
+		"deploy to [user@]host[:port] over SSH; the state file stays on this machine")
+	rootCmd.PersistentFlags().StringSliceVar(&sshKeys, "ssh-key", nil,
+		"private key for --host (repeatable, default ssh-agent and ~/.ssh/id_*)")
+	rootCmd.PersistentFlags().StringVar(&sshKnownHosts, "ssh-known-hosts", "",
+		"known_hosts file the --host key is checked against (default ~/.ssh/known_hosts)")
+}
+
+// openHost connects to --host on first use and returns nil without it.
+func openHost() (*remote.Client, error) {
+	if hostTarget == "" || hostClient != nil {
+		return hostClient, nil
+	}
+	c, err := remote.Dial(remote.Config{Target: hostTarget, KeyFiles: sshKeys, KnownHosts: sshKnownHosts})
+	if err != nil {
+		return nil, err
+	}
+	hostClient = c
+	return c, nil
+}
+
+func closeHost() {
+	if hostClient != nil {
+		hostClient.Close()
+		hostClient = nil
+	}
+}
+
+// onHost points opts at --host, if given.
+func onHost(opts *deployer.Options) error {
+	c, err := openHost()
+	if err != nil || c == nil {
+		return err
+	}
+	opts.FS, opts.Runner, opts.Host = c, c, c.Name()
+	return nil
+}
+
+// hostTargets returns the filesystem and runner of --host or of this
+// machine.
+func hostTargets() (fsys.FS, runner.Runner, error) {
+	c, err := openHost()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c == nil {
+		return fsys.Local{}, runner.Local{}, nil
+	}
+	return c, c, nil
+}
+
+// requireLocal rejects --host for commands that only work on the server.
+func requireLocal(cmd *cobra.Command) error {
+	if hostTarget == "" {
+		return nil
+	}
+	return fmt.Errorf("%s does not support --host; run it on the server", cmd.CommandPath())
+}
+
+// hostStatePath is the default state file for target, kept per host in the
+// user configuration directory.
+func hostStatePath(target string) (string, error) {
+	name, err := remote.CanonicalName(target)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("locate state for %s: %w", name, err)
+	}
+	return filepath.Join(dir, "sing-box-deploy", "hosts", name, "state.json"), nil
+}
@@ -1,33 +1,61 @@
 package cmd
 
 import (
-	"errors"
-	"fmt"
 	"sort"
+	"time"
 
-	"github.com/rogeecn/sing-box-deploy/internal/state"
 	"github.com/spf13/cobra"
 )
 
+var listDomain string
+
+// listOutput is the structured result of list.
+type listOutput struct {
+	Version     int              `json:"version" yaml:"version"`
+	StateFile   string           `json:"state_file" yaml:"state_file"`
+	Deployments []deploymentView `json:"deployments" yaml:"deployments"`
+}
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "Show deployed inbound entries",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		st, err := state.Load(getStatePath())
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		deployments, err := st.Select(listDomain)
 		if err != nil {
-			if errors.Is(err, state.ErrNotFound) {
-				return fmt.Errorf("state file not found, run deploy first")
-			}
 			return err
 		}
-		cmd.Printf("Domain: %s\n", st.Domain)
-		cmd.Printf("Subscription file: %s\n", st.SubscriptionFile)
-		cmd.Println("Inbounds:")
-		sort.Slice(st.Inbounds, func(i, j int) bool {
-			return st.Inbounds[i].Tag < st.Inbounds[j].Tag
-		})
-		for _, inbound := range st.Inbounds {
-			cmd.Printf("- %s [%s/%s] port:%d path:%s\n", inbound.Tag, inbound.Protocol, inbound.Transport, inbound.ListenPort, inbound.Path)
+		if structuredOutput() {
+			out := listOutput{
+				Version:     outputVersion,
+				StateFile:   getStatePath(),
+				Deployments: []deploymentView{},
+			}
+			for _, dep := range deployments {
+				out.Deployments = append(out.Deployments, newDeploymentView(dep))
+			}
+			return writeOutput(cmd, out)
+		}
+		cmd.Printf("State file: %s\n", getStatePath())
+		for i, dep := range deployments {
+			if i > 0 {
+				cmd.Println()
+			}
+			cmd.Printf("Domain: %s\n", dep.Domain)
+			cmd.Printf("Subscription file: %s\n", dep.SubscriptionFile)
+			if p := dep.Rotation; p != nil {
+				cmd.Printf("Rotation: every %s, next at %s\n", time.Duration(p.Interval), p.NextRotation().Format(time.RFC3339))
+			}
+			cmd.Println("Inbounds:")
+			sort.Slice(dep.Inbounds, func(i, j int) bool {
+				return dep.Inbounds[i].Tag < dep.Inbounds[j].Tag
+			})
+			for _, inbound := range dep.Inbounds {
+				cmd.Printf("- %s [%s/%s] port:%d path:%s\n", inbound.Tag, inbound.Protocol, inbound.Transport, inbound.ListenPort, inbound.Path)
+			}
 		}
 		return nil
 	},
@@ -35,4 +63,5 @@ var listCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().StringVar(&listDomain, "domain", "", "only show the given domain (default all)")
 }
@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	logsTags   []string
+	logsDomain string
+	logsLines  int
+	logsFollow bool
+	logsFile   string
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Show the sing-box log, optionally only for some inbounds",
+	Long: `Print the last lines of the sing-box log and optionally follow it. The log is
+read from the file configured with deploy --log-output, or from the journal
+when sing-box logs to journald. --tag and --domain keep the connections
+accepted by those inbounds: the line naming the inbound and every later line
+with the same connection ID.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireLocal(cmd); err != nil {
+			return err
+		}
+		file := logsFile
+		var tags []string
+		tags = append(tags, logsTags...)
+		if file == "" || logsDomain != "" {
+			st, err := loadState()
+			if err != nil {
+				return err
+			}
+			if file == "" {
+				file = st.Common.Log.File()
+			}
+			if logsDomain != "" {
+				deployments, err := st.Select(logsDomain)
+				if err != nil {
+					return err
+				}
+				for _, inbound := range deployments[0].Inbounds {
+					tags = append(tags, inbound.Tag)
+				}
+			}
+		}
+		var filter *logFilter
+		if len(tags) > 0 {
+			filter = newLogFilter(tags)
+		}
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		out := cmd.OutOrStdout()
+		var err error
+		if file == "" {
+			err = tailJournal(ctx, out, filter)
+		} else {
+			err = tailFile(ctx, out, file, filter)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+	logsCmd.Flags().StringSliceVar(&logsTags, "tag", nil, "only show connections of this inbound tag (repeatable)")
+	logsCmd.Flags().StringVar(&logsDomain, "domain", "", "only show connections of the inbounds of this domain")
+	logsCmd.Flags().IntVarP(&logsLines, "lines", "n", 50, "number of lines to show, 0 for all")
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "keep printing new lines")
+	logsCmd.Flags().StringVar(&logsFile, "file", "", "read this log file instead of the configured output")
+}
+
+// connID matches the "[<id> <elapsed>]" prefix sing-box writes on every
+// line about a connection.
+var connID = regexp.MustCompile(`\[(\d+) [^\]]*\]`)
+
+// maxTrackedConns bounds the connection IDs a filter remembers.
+const maxTrackedConns = 10000
+
+// logFilter keeps the lines of connections accepted by some inbounds. Only
+// the first line of a connection names the inbound ("inbound/vless[tag]");
+// later lines about routing, dialing and errors carry just its ID.
+type logFilter struct {
+	tags  []string
+	conns map[string]struct{}
+	order []string
+}
+
+func newLogFilter(tags []string) *logFilter {
+	f := &logFilter{conns: map[string]struct{}{}}
+	for _, tag := range tags {
+		f.tags = append(f.tags, "["+tag+"]")
+	}
+	return f
+}
+
+func (f *logFilter) match(line string) bool {
+	if f == nil {
+		return true
+	}
+	id := ""
+	if m := connID.FindStringSubmatch(line); m != nil {
+		id = m[1]
+	}
+	for _, tag := range f.tags {
+		if strings.Contains(line, tag) {
+			if id != "" {
+				f.remember(id)
+			}
+			return true
+		}
+	}
+	_, ok := f.conns[id]
+	return id != "" && ok
+}
+
+func (f *logFilter) remember(id string) {
+	if _, ok := f.conns[id]; ok {
+		return
+	}
+	if len(f.order) == maxTrackedConns {
+		delete(f.conns, f.order[0])
+		f.order = f.order[1:]
+	}
+	f.conns[id] = struct{}{}
+	f.order = append(f.order, id)
+}
+
+// lastLines collects matching lines, keeping the last logsLines of them.
+type lastLines struct {
+	filter *logFilter
+	lines  []string
+}
+
+func (l *lastLines) add(line string) {
+	if !l.filter.match(line) {
+		return
+	}
+	l.lines = append(l.lines, line)
+	if logsLines > 0 && len(l.lines) > 2*logsLines {
+		l.lines = append(l.lines[:0], l.lines[len(l.lines)-logsLines:]...)
+	}
+}
+
+func (l *lastLines) flush(w io.Writer) {
+	lines := l.lines
+	if logsLines > 0 && len(lines) > logsLines {
+		lines = lines[len(lines)-logsLines:]
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// tailFile prints the end of path and, with --follow, polls it for new
+// lines. A file that shrinks was truncated by logrotate's copytruncate and
+// is read again from the start.
+func tailFile(ctx context.Context, w io.Writer, path string, filter *logFilter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	defer f.Close()
+	backlog := &lastLines{filter: filter}
+	reader := bufio.NewReader(f)
+	offset, partial, err := readLines(reader, backlog.add)
+	if err != nil {
+		return err
+	}
+	if !logsFollow {
+		if partial != "" {
+			backlog.add(partial)
+		}
+		backlog.flush(w)
+		return nil
+	}
+	// An unterminated last line is printed once it is complete.
+	backlog.flush(w)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() < offset {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			offset, partial = 0, ""
+			reader.Reset(f)
+		}
+		n, rest, err := readLines(reader, func(line string) {
+			if line = partial + line; filter.match(line) {
+				fmt.Fprintln(w, line)
+			}
+			partial = ""
+		})
+		if err != nil {
+			return err
+		}
+		offset += n
+		partial += rest
+	}
+}
+
+// readLines calls fn for every complete line in r and returns the bytes
+// read and the trailing incomplete line.
+func readLines(r *bufio.Reader, fn func(string)) (int64, string, error) {
+	var n int64
+	for {
+		line, err := r.ReadString('\n')
+		n += int64(len(line))
+		if err == io.EOF {
+			return n, line, nil
+		}
+		if err != nil {
+			return n, "", err
+		}
+		fn(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// tailJournal prints the sing-box entries of the journal. The backlog is
+// read first so the line limit applies after filtering; following then
+// resumes from the cursor of its last entry.
+func tailJournal(ctx context.Context, w io.Writer, filter *logFilter) error {
+	args := []string{"-u", service.SingBoxUnit, "-o", "cat", "--no-pager", "--show-cursor"}
+	if filter == nil && logsLines > 0 {
+		args = append(args, "-n", fmt.Sprint(logsLines))
+	}
+	out, err := exec.CommandContext(ctx, "journalctl", args...).Output()
+	if err != nil {
+		return fmt.Errorf("journalctl: %w", err)
+	}
+	backlog := &lastLines{filter: filter}
+	cursor := ""
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if c, ok := strings.CutPrefix(line, "-- cursor: "); ok {
+			cursor = c
+			continue
+		}
+		if line != "" {
+			backlog.add(line)
+		}
+	}
+	backlog.flush(w)
+	if !logsFollow {
+		return nil
+	}
+	args = []string{"-u", service.SingBoxUnit, "-o", "cat", "--no-pager", "-f"}
+	if cursor != "" {
+		args = append(args, "--after-cursor", cursor, "-n", "all")
+	} else {
+		args = append(args, "-n", "0")
+	}
+	follow := exec.CommandContext(ctx, "journalctl", args...)
+	stdout, err := follow.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := follow.Start(); err != nil {
+		return fmt.Errorf("journalctl: %w", err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); filter.match(line) {
+			fmt.Fprintln(w, line)
+		}
+	}
+	if err := follow.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("journalctl: %w", err)
+	}
+	return nil
+}
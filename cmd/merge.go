@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/remote"
+	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
+	"github.com/spf13/cobra"
+)
+
+var (
+	mergeOut      string
+	mergeName     string
+	mergeFormats  []string
+	mergeTestURL  string
+	mergeInterval time.Duration
+)
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge [name=]<state file>...",
+	Short: "Combine the subscriptions of several state files",
+	Long: `Combine the share links recorded in several state files, e.g. copied from
+different servers, into one subscription per format. Entries are named
+<node>-<inbound>, where the node is the name given before "=", else the
+profile name, the host of a state deployed with --host or the domain. Links that
+reach the same endpoint are kept once. The Clash subscription adds url-test
+(AUTO) and fallback (FALLBACK) groups over all nodes, the sing-box one a
+urltest outbound (auto) that the proxy selector uses by default.`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		formats := mergeFormats
+		if len(formats) == 0 {
+			formats = share.Formats
+		}
+		for _, format := range formats {
+			if !share.ValidFormat(format) {
+				return usageError{fmt.Errorf("unknown subscription format %q (want %s)", format, strings.Join(share.Formats, ", "))}
+			}
+		}
+		var entries []share.Entry
+		var sources []mergeEntry
+		names := map[string]int{}
+		for _, arg := range args {
+			node, path := splitMergeArg(arg)
+			st, err := state.Load(path)
+			if err != nil {
+				if errors.Is(err, state.ErrNotFound) {
+					return fmt.Errorf("%w: %s", state.ErrNotFound, path)
+				}
+				return err
+			}
+			host := ""
+			if st.Host != "" {
+				if _, h, _, err := remote.ParseTarget(st.Host); err == nil {
+					host = h
+				}
+			}
+			for _, domain := range st.Domains() {
+				dep := st.Deployments[domain]
+				depNode := cmp.Or(node, dep.ProfileName, host, dep.Domain)
+				for _, inbound := range dep.Inbounds {
+					name := uniqueName(names, share.NodeEntryName(depNode, inbound.Tag, dep.Domain))
+					entries = append(entries, share.Entry{Name: name, Link: inbound.ShareURL})
+					sources = append(sources, mergeEntry{Name: name, StateFile: path, Domain: dep.Domain, Key: inbound.Key, ShareURL: inbound.ShareURL})
+				}
+			}
+		}
+		kept, dropped, err := share.Dedupe(entries)
+		if err != nil {
+			return err
+		}
+		if len(kept) == 0 {
+			return fmt.Errorf("the state files record no inbounds")
+		}
+
+		out := mergeOutput{
+			Version:       outputVersion,
+			Entries:       []mergeEntry{},
+			Duplicates:    []mergeDuplicate{},
+			Subscriptions: map[string]string{},
+		}
+		bySource := map[string]mergeEntry{}
+		for _, src := range sources {
+			bySource[src.Name] = src
+		}
+		for _, e := range kept {
+			out.Entries = append(out.Entries, bySource[e.Name])
+		}
+		for _, d := range dropped {
+			out.Duplicates = append(out.Duplicates, mergeDuplicate{mergeEntry: bySource[d.Name], Of: d.Of})
+		}
+
+		tx := txn.New()
+		defer tx.Rollback()
+		if err := tx.MkdirAll(mergeOut, 0o750); err != nil {
+			return err
+		}
+		balance := share.Balance{URL: mergeTestURL, Interval: mergeInterval}
+		for _, format := range formats {
+			content, err := share.RenderMerged(format, mergeName, kept, balance)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(mergeOut, share.FileName(mergeName, format))
+			if err := tx.WriteFile(path, content, 0o640); err != nil {
+				return err
+			}
+			out.Subscriptions[format] = path
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		if structuredOutput() {
+			return writeOutput(cmd, out)
+		}
+		for _, d := range out.Duplicates {
+			cmd.Printf("Skipped %s: same endpoint as %s\n", d.Name, d.Of)
+		}
+		cmd.Printf("Merged %d nodes from %d state files\n", len(out.Entries), len(args))
+		for _, format := range share.Formats {
+			if path, ok := out.Subscriptions[format]; ok {
+				cmd.Printf("Subscription: %s\n", path)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mergeCmd)
+	mergeCmd.Flags().StringVar(&mergeOut, "out", ".", "directory the merged subscriptions are written to")
+	mergeCmd.Flags().StringVar(&mergeName, "name", "merged", "title of the subscriptions and base of their file names")
+	mergeCmd.Flags().StringSliceVar(&mergeFormats, "format", nil, "subscription format to write (repeatable, default all)")
+	mergeCmd.Flags().StringVar(&mergeTestURL, "test-url", share.DefaultTestURL, "URL the url-test, fallback and urltest groups fetch to measure nodes")
+	mergeCmd.Flags().DurationVar(&mergeInterval, "test-interval", 5*time.Minute, "interval between node measurements")
+}
+
+// mergeOutput is the structured result of merge.
+type mergeOutput struct {
+	Version    int              `json:"version" yaml:"version"`
+	Entries    []mergeEntry     `json:"entries" yaml:"entries"`
+	Duplicates []mergeDuplicate `json:"duplicates" yaml:"duplicates"`
+	// Subscriptions maps each format to the written file.
+	Subscriptions map[string]string `json:"subscriptions" yaml:"subscriptions"`
+}
+
+type mergeEntry struct {
+	Name      string `json:"name" yaml:"name"`
+	StateFile string `json:"state_file" yaml:"state_file"`
+	Domain    string `json:"domain" yaml:"domain"`
+	Key       string `json:"key" yaml:"key"`
+	ShareURL  string `json:"share_url" yaml:"share_url"`
+}
+
+type mergeDuplicate struct {
+	mergeEntry `yaml:",inline"`
+	// Of names the kept entry with the same endpoint.
+	Of string `json:"of" yaml:"of"`
+}
+
+// splitMergeArg splits "name=path"; a "=" inside a path does not count.
+func splitMergeArg(arg string) (name, path string) {
+	if i := strings.Index(arg, "="); i > 0 && !strings.ContainsRune(arg[:i], filepath.Separator) {
+		return arg[:i], arg[i+1:]
+	}
+	return "", arg
+}
+
+// uniqueName returns name, or name with a numeric suffix if it was
+// returned before.
+func uniqueName(seen map[string]int, name string) string {
+	seen[name]++
+	if n := seen[name]; n > 1 {
+		return uniqueName(seen, name+"-"+strconv.Itoa(n))
+	}
+	return name
+}
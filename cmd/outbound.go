@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	outboundWireGuard string
+	outboundReserved  []int
+	outboundProxy     string
+	outboundLink      string
+	outboundReplace   bool
+	outboundFinal     bool
+	outboundSkipVal   bool
+
+	outboundDomains        []string
+	outboundDomainSuffixes []string
+	outboundDomainKeywords []string
+	outboundGeosite        []string
+	outboundGeoIP          []string
+	outboundRuleSets       []string
+)
+
+// outboundListOutput is the structured result of the outbound commands.
+type outboundListOutput struct {
+	Version   int            `json:"version" yaml:"version"`
+	StateFile string         `json:"state_file" yaml:"state_file"`
+	Final     string         `json:"final" yaml:"final"`
+	Outbounds []outboundView `json:"outbounds" yaml:"outbounds"`
+}
+
+type outboundView struct {
+	Tag      string         `json:"tag" yaml:"tag"`
+	Type     string         `json:"type" yaml:"type"`
+	Endpoint string         `json:"endpoint" yaml:"endpoint"`
+	Rules    []singbox.Rule `json:"rules" yaml:"rules"`
+}
+
+var outboundCmd = &cobra.Command{
+	Use:   "outbound",
+	Short: "Manage upstream outbounds such as WARP or SOCKS egress",
+}
+
+var outboundAddCmd = &cobra.Command{
+	Use:          "add <tag>",
+	SilenceUsage: true,
+	Short:        "Add an outbound and route selected traffic through it",
+	Long: `Add an outbound to 00_common.json. Exactly one of --wireguard, --proxy or
+--link selects its kind. The matcher flags add one routing rule sending
+matching traffic through the outbound, replacing its earlier rules with
+--replace; --final sends everything else.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tag := strings.TrimSpace(args[0])
+		outbound, err := outboundFromFlags(cmd, tag)
+		if err != nil {
+			return err
+		}
+		rule := singbox.Rule{
+			Domain:        outboundDomains,
+			DomainSuffix:  outboundDomainSuffixes,
+			DomainKeyword: outboundDomainKeywords,
+			Geosite:       outboundGeosite,
+			GeoIP:         outboundGeoIP,
+			RuleSet:       outboundRuleSets,
+			Outbound:      tag,
+		}
+		hasRule := len(rule.Domain)+len(rule.DomainSuffix)+len(rule.DomainKeyword)+
+			len(rule.Geosite)+len(rule.GeoIP)+len(rule.RuleSet) > 0
+		return updateOutbounds(cmd, func(common *singbox.Common) error {
+			replaced := false
+			for i := range common.Outbounds {
+				if common.Outbounds[i].Tag == tag {
+					if !outboundReplace {
+						return fmt.Errorf("outbound %s already exists, use --replace to update it", tag)
+					}
+					common.Outbounds[i] = outbound
+					replaced = true
+				}
+			}
+			if !replaced {
+				common.Outbounds = append(common.Outbounds, outbound)
+			}
+			if hasRule {
+				if replaced {
+					common.RemoveRules(tag)
+				}
+				common.Routing.Rules = append(common.Routing.Rules, rule)
+			}
+			if outboundFinal {
+				common.Routing.Final = tag
+			}
+			return nil
+		})
+	},
+}
+
+var outboundRemoveCmd = &cobra.Command{
+	Use:          "remove <tag>",
+	SilenceUsage: true,
+	Short:        "Remove an outbound and the routing rules that use it",
+	Args:         cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tag := strings.TrimSpace(args[0])
+		return updateOutbounds(cmd, func(common *singbox.Common) error {
+			if !common.RemoveOutbound(tag) {
+				return fmt.Errorf("unknown outbound %q", tag)
+			}
+			return nil
+		})
+	},
+}
+
+var outboundListCmd = &cobra.Command{
+	Use:          "list",
+	SilenceUsage: true,
+	Short:        "Show the configured outbounds and their routing rules",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		return printOutbounds(cmd, st.Common)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(outboundCmd)
+	outboundCmd.AddCommand(outboundAddCmd, outboundRemoveCmd, outboundListCmd)
+
+	flags := outboundAddCmd.Flags()
+	flags.StringVar(&outboundWireGuard, "wireguard", "", "WireGuard endpoint from a wg-quick profile, e.g. wgcf-profile.conf for WARP")
+	flags.IntSliceVar(&outboundReserved, "reserved", nil, "WireGuard reserved bytes, e.g. the WARP client id 12,34,56")
+	flags.StringVar(&outboundProxy, "proxy", "", "upstream proxy URL: socks5://[user:pass@]host:port or http(s)://[user:pass@]host:port")
+	flags.StringVar(&outboundLink, "link", "", "another server's vless:// or vmess:// share link")
+	flags.BoolVar(&outboundReplace, "replace", false, "replace an existing outbound with the same tag")
+	flags.BoolVar(&outboundFinal, "final", false, "route traffic no rule matches through this outbound")
+	flags.StringSliceVar(&outboundDomains, "domain", nil, "route this domain through the outbound (repeatable)")
+	flags.StringSliceVar(&outboundDomainSuffixes, "domain-suffix", nil, "route domains with this suffix through the outbound (repeatable)")
+	flags.StringSliceVar(&outboundDomainKeywords, "domain-keyword", nil, "route domains containing this keyword through the outbound (repeatable)")
+	flags.StringSliceVar(&outboundGeosite, "geosite", nil, "route a geosite rule-set, e.g. openai, through the outbound (repeatable)")
+	flags.StringSliceVar(&outboundGeoIP, "geoip", nil, "route a geoip rule-set through the outbound (repeatable)")
+	flags.StringSliceVar(&outboundRuleSets, "rule-set", nil, "route a rule-set declared in the routing settings through the outbound (repeatable)")
+
+	for _, c := range []*cobra.Command{outboundAddCmd, outboundRemoveCmd} {
+		addServiceFlags(c)
+		c.Flags().
+			BoolVar(&outboundSkipVal, "skip-validate", false, "promote files without running sing-box check")
+	}
+}
+
+// outboundFromFlags builds the outbound selected by --wireguard, --proxy or
+// --link.
+func outboundFromFlags(cmd *cobra.Command, tag string) (singbox.Outbound, error) {
+	kinds := 0
+	for _, name := range []string{"wireguard", "proxy", "link"} {
+		if cmd.Flags().Changed(name) {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return singbox.Outbound{}, usageError{errors.New("exactly one of --wireguard, --proxy or --link is required")}
+	}
+	switch {
+	case outboundWireGuard != "":
+		data, err := os.ReadFile(outboundWireGuard)
+		if err != nil {
+			return singbox.Outbound{}, fmt.Errorf("read WireGuard profile: %w", err)
+		}
+		wg, err := singbox.ParseWireGuard(data)
+		if err != nil {
+			return singbox.Outbound{}, fmt.Errorf("WireGuard profile %s: %w", outboundWireGuard, err)
+		}
+		wg.Reserved = outboundReserved
+		o := singbox.Outbound{Tag: tag, Type: singbox.OutboundWireGuard, WireGuard: wg}
+		return o, o.Validate()
+	case outboundProxy != "":
+		return singbox.ProxyOutbound(tag, outboundProxy)
+	default:
+		return singbox.LinkOutbound(tag, outboundLink)
+	}
+}
+
+// updateOutbounds applies update to the host-wide settings, re-renders
+// 00_common.json and restarts the services.
+func updateOutbounds(cmd *cobra.Command, update func(*singbox.Common) error) error {
+	opts := deployer.Options{
+		RootDir:       getRootDir(),
+		StateFile:     getStatePath(),
+		SingBoxBinary: singBoxBin,
+		CaddyBinary:   caddyBin,
+		SkipValidate:  outboundSkipVal,
+		WaitLock:      waitLock,
+	}
+	if err := onHost(&opts); err != nil {
+		return err
+	}
+	st, err := deployer.UpdateCommon(opts, update)
+	if err != nil {
+		if errors.Is(err, state.ErrNotFound) {
+			return fmt.Errorf("%w: %s, run deploy first", state.ErrNotFound, getStatePath())
+		}
+		return err
+	}
+	if domains := st.Domains(); len(domains) > 0 {
+		dep := st.Deployments[domains[0]]
+		if err := applyServices(cmd, dep.RootDir, dep.CaddyFile); err != nil {
+			return err
+		}
+	}
+	return printOutbounds(cmd, st.Common)
+}
+
+func printOutbounds(cmd *cobra.Command, common singbox.Common) error {
+	final := common.Routing.Final
+	if final == "" {
+		final = singbox.OutboundDirect
+	}
+	out := outboundListOutput{
+		Version:   outputVersion,
+		StateFile: getStatePath(),
+		Final:     final,
+		Outbounds: []outboundView{},
+	}
+	for _, o := range common.Outbounds {
+		view := outboundView{Tag: o.Tag, Type: o.Type, Endpoint: o.Endpoint(), Rules: []singbox.Rule{}}
+		for _, rule := range common.Routing.Rules {
+			if rule.Outbound == o.Tag {
+				view.Rules = append(view.Rules, rule)
+			}
+		}
+		out.Outbounds = append(out.Outbounds, view)
+	}
+	if structuredOutput() {
+		return writeOutput(cmd, out)
+	}
+	if len(out.Outbounds) == 0 {
+		cmd.Println("No outbounds configured")
+		return nil
+	}
+	cmd.Printf("Final outbound: %s\n", final)
+	for _, view := range out.Outbounds {
+		cmd.Printf("- %s [%s] %s\n", view.Tag, view.Type, view.Endpoint)
+		for _, rule := range view.Rules {
+			cmd.Printf("    %s\n", describeRule(rule))
+		}
+	}
+	return nil
+}
+
+// describeRule summarises the matchers of rule on one line.
+func describeRule(rule singbox.Rule) string {
+	var parts []string
+	add := func(name string, values []string) {
+		if len(values) > 0 {
+			parts = append(parts, name+"="+strings.Join(values, ","))
+		}
+	}
+	add("protocol", rule.Protocol)
+	add("domain", rule.Domain)
+	add("domain_suffix", rule.DomainSuffix)
+	add("domain_keyword", rule.DomainKeyword)
+	add("domain_regex", rule.DomainRegex)
+	add("ip_cidr", rule.IPCIDR)
+	add("rule_set", rule.RuleSet)
+	add("geosite", rule.Geosite)
+	add("geoip", rule.GeoIP)
+	if rule.IPIsPrivate {
+		parts = append(parts, "ip_is_private")
+	}
+	for _, port := range rule.Port {
+		parts = append(parts, fmt.Sprintf("port=%d", port))
+	}
+	return strings.Join(parts, " ")
+}
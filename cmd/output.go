@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/prompt"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats accepted by --output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// outputVersion is bumped whenever a field of the structured documents below
+// changes meaning or is removed. Adding fields does not bump it.
+const outputVersion = 1
+
+var outputFormat string
+
+func validateOutputFormat() error {
+	switch outputFormat {
+	case outputText, outputJSON, outputYAML:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q (want text, json or yaml)", outputFormat)
+	}
+}
+
+// structuredOutput reports whether the command should print a document
+// instead of human-readable text.
+func structuredOutput() bool {
+	return outputFormat == outputJSON || outputFormat == outputYAML
+}
+
+// writeOutput encodes v to stdout in the selected structured format.
+func writeOutput(cmd *cobra.Command, v any) error {
+	return encodeOutput(cmd.OutOrStdout(), outputFormat, v)
+}
+
+func encodeOutput(w io.Writer, format string, v any) error {
+	if format == outputYAML {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// outputFromArgs finds the --output value in raw arguments.
+func outputFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		for _, name := range []string{"--output", "-o"} {
+			switch {
+			case arg == name && i+1 < len(args):
+				return args[i+1]
+			case strings.HasPrefix(arg, name+"="):
+				return strings.TrimPrefix(arg, name+"=")
+			case name == "-o" && strings.HasPrefix(arg, "-o") && len(arg) > 2:
+				return arg[2:]
+			}
+		}
+	}
+	return ""
+}
+
+// inboundView is the stable structured form of an inbound.
+type inboundView struct {
+	Key       string     `json:"key" yaml:"key"`
+	Tag       string     `json:"tag" yaml:"tag"`
+	Name      string     `json:"name" yaml:"name"`
+	Protocol  string     `json:"protocol" yaml:"protocol"`
+	Transport string     `json:"transport" yaml:"transport"`
+	Port      int        `json:"port" yaml:"port"`
+	Path      string     `json:"path" yaml:"path"`
+	Host      string     `json:"host" yaml:"host"`
+	Users     []userView `json:"users" yaml:"users"`
+	ShareURL  string     `json:"share_url" yaml:"share_url"`
+}
+
+type userView struct {
+	Name      string     `json:"name,omitempty" yaml:"name,omitempty"`
+	UUID      string     `json:"uuid" yaml:"uuid"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" yaml:"expires_at,omitempty"`
+	// Quota is the monthly traffic allowance in bytes.
+	Quota      int64      `json:"quota,omitempty" yaml:"quota,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty" yaml:"valid_until,omitempty"`
+	Disabled   string     `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+}
+
+// deploymentView is the stable structured form of a deployed domain.
+type deploymentView struct {
+	Domain        string            `json:"domain" yaml:"domain"`
+	Email         string            `json:"email" yaml:"email"`
+	RootDir       string            `json:"root_dir" yaml:"root_dir"`
+	CaddyFile     string            `json:"caddy_file" yaml:"caddy_file"`
+	TLSMode       string            `json:"tls_mode" yaml:"tls_mode"`
+	Proxy         string            `json:"proxy" yaml:"proxy"`
+	Subscriptions map[string]string `json:"subscriptions" yaml:"subscriptions"`
+	Inbounds      []inboundView     `json:"inbounds" yaml:"inbounds"`
+	Rotation      *rotationView     `json:"rotation,omitempty" yaml:"rotation,omitempty"`
+	LastUpdated   time.Time         `json:"last_updated" yaml:"last_updated"`
+}
+
+// rotationView is the structured form of a rotation policy.
+type rotationView struct {
+	Interval     string    `json:"interval" yaml:"interval"`
+	Keys         []string  `json:"keys" yaml:"keys"`
+	UUID         bool      `json:"uuid" yaml:"uuid"`
+	Path         bool      `json:"path" yaml:"path"`
+	Port         bool      `json:"port" yaml:"port"`
+	Grace        string    `json:"grace" yaml:"grace"`
+	LastRotated  time.Time `json:"last_rotated" yaml:"last_rotated"`
+	NextRotation time.Time `json:"next_rotation" yaml:"next_rotation"`
+}
+
+func newInboundView(inbound state.Inbound) inboundView {
+	view := inboundView{
+		Key:       inbound.Key,
+		Tag:       inbound.Tag,
+		Name:      inbound.Name,
+		Protocol:  inbound.Protocol,
+		Transport: inbound.Transport,
+		Port:      inbound.ListenPort,
+		Path:      inbound.Path,
+		Host:      inbound.Host,
+		ShareURL:  inbound.ShareURL,
+		Users:     []userView{},
+	}
+	for _, u := range inbound.Users {
+		view.Users = append(view.Users, userView{
+			Name:       u.Name,
+			UUID:       u.UUID,
+			ExpiresAt:  u.ExpiresAt,
+			Quota:      u.Quota,
+			ValidUntil: u.ValidUntil,
+			Disabled:   u.Disabled,
+		})
+	}
+	if len(view.Users) == 0 {
+		view.Users = append(view.Users, userView{UUID: inbound.UUID})
+	}
+	return view
+}
+
+func newDeploymentView(dep *state.Deployment) deploymentView {
+	view := deploymentView{
+		Domain:        dep.Domain,
+		Email:         dep.Email,
+		RootDir:       dep.RootDir,
+		CaddyFile:     dep.CaddyFile,
+		TLSMode:       dep.TLSMode,
+		Proxy:         dep.Proxy,
+		Subscriptions: map[string]string{},
+		Inbounds:      []inboundView{},
+		LastUpdated:   dep.LastUpdated,
+	}
+	if view.TLSMode == "" {
+		view.TLSMode = deployer.TLSModeACME
+	}
+	if view.Proxy == "" {
+		view.Proxy = deployer.ProxyCaddy
+	}
+	for format, path := range dep.SubscriptionFiles {
+		view.Subscriptions[format] = path
+	}
+	if len(view.Subscriptions) == 0 && dep.SubscriptionFile != "" {
+		view.Subscriptions["text"] = dep.SubscriptionFile
+	}
+	for _, inbound := range dep.Inbounds {
+		view.Inbounds = append(view.Inbounds, newInboundView(inbound))
+	}
+	if p := dep.Rotation; p != nil {
+		view.Rotation = &rotationView{
+			Interval:     time.Duration(p.Interval).String(),
+			Keys:         append([]string{}, p.Keys...),
+			UUID:         p.UUID,
+			Path:         p.Path,
+			Port:         p.Port,
+			Grace:        time.Duration(p.Grace).String(),
+			LastRotated:  p.LastRotated,
+			NextRotation: p.NextRotation(),
+		}
+	}
+	return view
+}
+
+// errorView is printed instead of cobra's "Error: ..." line when a
+// structured output format is selected.
+type errorView struct {
+	Version int         `json:"version" yaml:"version"`
+	Error   errorDetail `json:"error" yaml:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code" yaml:"code"`
+	Message string `json:"message" yaml:"message"`
+	Details string `json:"details,omitempty" yaml:"details,omitempty"`
+}
+
+// Error codes reported in structured errors.
+const (
+	codeUsage            = "usage"
+	codeStateNotFound    = "state_not_found"
+	codeUnknownDomain    = "unknown_domain"
+	codeStateLocked      = "state_locked"
+	codeInputRequired    = "input_required"
+	codeValidationFailed = "validation_failed"
+	codeCheckFailed      = "check_failed"
+	codeInternal         = "error"
+)
+
+// usageError marks invalid flags or arguments.
+type usageError struct{ err error }
+
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
+
+// checkError is returned by commands that already printed a report whose
+// checks failed; it only sets the exit status in structured mode.
+type checkError struct{ msg string }
+
+func (e checkError) Error() string { return e.msg }
+
+func newErrorView(err error) errorView {
+	detail := errorDetail{Code: codeInternal, Message: err.Error()}
+	var validation *deployer.ValidationError
+	var usage usageError
+	switch {
+	case errors.As(err, &usage):
+		detail.Code = codeUsage
+	case errors.As(err, &validation):
+		detail.Code = codeValidationFailed
+		detail.Message = validation.Tool + " failed: " + validation.Err.Error()
+		detail.Details = validation.Output
+	case errors.Is(err, state.ErrNotFound):
+		detail.Code = codeStateNotFound
+	case errors.Is(err, state.ErrUnknownDomain):
+		detail.Code = codeUnknownDomain
+	case errors.Is(err, state.ErrLocked):
+		detail.Code = codeStateLocked
+	case errors.Is(err, prompt.ErrNonInteractive), errors.Is(err, prompt.ErrNoInput):
+		detail.Code = codeInputRequired
+	}
+	return errorView{Version: outputVersion, Error: detail}
+}
+
+// reportError prints err as a structured document; in text mode cobra has
+// already printed it.
+func reportError(cmd *cobra.Command, err error) {
+	if !structuredOutput() {
+		return
+	}
+	var check checkError
+	if errors.As(err, &check) {
+		return
+	}
+	encodeOutput(cmd.OutOrStdout(), outputFormat, newErrorView(err))
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/spf13/cobra"
+)
+
+var (
+	removeDomain  string
+	removeSkipVal bool
+)
+
+var removeCmd = &cobra.Command{
+	Use:   "remove [domain]",
+	Short: "Remove a deployed domain and its generated files",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain, err := domainArg(args, removeDomain)
+		if err != nil {
+			return err
+		}
+		opts := deployer.Options{
+			Domain:        domain,
+			StateFile:     getStatePath(),
+			SingBoxBinary: singBoxBin,
+			CaddyBinary:   caddyBin,
+			SkipValidate:  removeSkipVal,
+			WaitLock:      waitLock,
+		}
+		if err := onHost(&opts); err != nil {
+			return err
+		}
+		dep, err := deployer.Remove(opts)
+		if err != nil {
+			return err
+		}
+		cmd.Printf("Removed %d inbounds for %s\n", len(dep.Inbounds), dep.Domain)
+		cmd.Printf("Caddyfile: %s\n", dep.CaddyFile)
+		return applyServices(cmd, dep.RootDir, dep.CaddyFile)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(removeCmd)
+	removeCmd.Flags().StringVar(&removeDomain, "domain", "", "domain to remove")
+	addServiceFlags(removeCmd)
+	removeCmd.Flags().
+		BoolVar(&removeSkipVal, "skip-validate", false, "promote files without running sing-box check and caddy validate")
+}
+
+// domainArg resolves the domain from either the positional argument or the
+// --domain flag.
+func domainArg(args []string, flagValue string) (string, error) {
+	domain := strings.ToLower(strings.TrimSpace(flagValue))
+	if len(args) > 0 {
+		arg := strings.ToLower(strings.TrimSpace(args[0]))
+		if domain != "" && arg != domain {
+			return "", fmt.Errorf("conflicting domains %q and %q", arg, domain)
+		}
+		domain = arg
+	}
+	if domain == "" {
+		return "", fmt.Errorf("domain is required")
+	}
+	return domain, nil
+}
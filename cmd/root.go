@@ -5,36 +5,189 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 
+	"github.com/rogeecn/sing-box-deploy/internal/prompt"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
 	"github.com/spf13/cobra"
 )
 
-var statePath string
+const (
+	defaultRootDir  = "/etc/sing-box"
+	stateEnv        = "SING_BOX_DEPLOY_STATE"
+	legacyStateFile = "sing-box-state.json"
+)
+
+var (
+	statePath string
+	rootDir   string
+	waitLock  bool
+
+	singBoxBin string
+	caddyBin   string
+
+	assumeYes bool
+	prompter  prompt.Prompter
+
+	resolvedStatePath string
+)
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "sing-box-deploy",
 	Short: "sing-box + Caddy deployment helper",
 	Long:  `Render sing-box inbounds, manage deployment metadata, and inspect generated subscription links.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateOutputFormat(); err != nil {
+			return usageError{err}
+		}
+		if structuredOutput() {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+		}
+		prompter = newPrompter(cmd)
+		path, err := discoverStatePath(cmd)
+		if err != nil {
+			return err
+		}
+		resolvedStatePath = path
+		return nil
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	err := rootCmd.Execute()
+	cmd, err := rootCmd.ExecuteC()
+	closeHost()
 	if err != nil {
+		reportError(cmd, err)
 		os.Exit(1)
 	}
 }
 
 func init() {
-	defaultState := filepath.Join("sing-box-state.json")
-	rootCmd.PersistentFlags().StringVar(&statePath, "state", defaultState, "state file for storing deployment metadata")
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		// Parsing stops at the first bad flag, which may precede --output.
+		if format := outputFromArgs(os.Args[1:]); format != "" {
+			outputFormat = format
+		}
+		if structuredOutput() {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+		}
+		return usageError{err}
+	})
+	rootCmd.PersistentFlags().
+		StringVarP(&outputFormat, "output", "o", outputText, "output format: text, json or yaml")
+	rootCmd.PersistentFlags().StringVar(&statePath, "state", "",
+		"state file for storing deployment metadata (default $"+stateEnv+" or <root>/state/state.json)")
+	rootCmd.PersistentFlags().StringVar(&rootDir, "root", "", "sing-box root directory (default /etc/sing-box)")
+	rootCmd.PersistentFlags().
+		StringVar(&singBoxBin, "sing-box-bin", "sing-box", "path to sing-box binary for helper commands")
+	rootCmd.PersistentFlags().StringVar(&caddyBin, "caddy-bin", "caddy", "path to caddy binary used for validation")
+	rootCmd.PersistentFlags().
+		BoolVar(&waitLock, "wait-lock", false, "wait for a concurrent run holding the state lock instead of failing")
+	rootCmd.PersistentFlags().
+		BoolVarP(&assumeYes, "yes", "y", false, "never prompt: answer yes to confirmations and require explicit flags for choices")
+	rootCmd.PersistentFlags().BoolVar(&assumeYes, "non-interactive", false, "alias for --yes")
+}
+
+// newPrompter disables prompts with --yes or when stdin is not a terminal,
+// as under cloud-init, CI or configuration management.
+func newPrompter(cmd *cobra.Command) prompt.Prompter {
+	in := cmd.InOrStdin()
+	if assumeYes || !prompt.IsTerminal(in) {
+		return prompt.Unattended{AssumeYes: assumeYes}
+	}
+	return prompt.NewTerminal(in, cmd.ErrOrStderr())
+}
+
+func getRootDir() string {
+	if rootDir == "" {
+		return defaultRootDir
+	}
+	return rootDir
 }
 
 func getStatePath() string {
-	return statePath
+	return resolvedStatePath
+}
+
+// discoverStatePath picks the state file in order of precedence: --state,
+// $SING_BOX_DEPLOY_STATE, the per-host file with --host,
+// <root>/state/state.json. The state lives in a
+// subdirectory because `sing-box -C <root>` merges every *.json in <root>. A
+// legacy sing-box-state.json in the working directory is offered for
+// migration when the root file does not exist yet.
+func discoverStatePath(cmd *cobra.Command) (string, error) {
+	if statePath != "" {
+		return statePath, nil
+	}
+	if env := os.Getenv(stateEnv); env != "" {
+		return env, nil
+	}
+	if hostTarget != "" {
+		return hostStatePath(hostTarget)
+	}
+	target := filepath.Join(getRootDir(), "state", "state.json")
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	}
+	if _, err := os.Stat(legacyStateFile); err != nil {
+		return target, nil
+	}
+	legacy, err := filepath.Abs(legacyStateFile)
+	if err != nil {
+		return "", err
+	}
+	out := cmd.ErrOrStderr()
+	move, err := prompter.Confirm(fmt.Sprintf("发现旧版状态文件 %s，是否迁移到 %s?", legacy, target), false)
+	if err != nil {
+		return "", err
+	}
+	if !move {
+		fmt.Fprintf(out, "Using legacy state file %s\n", legacy)
+		return legacy, nil
+	}
+	if err := moveStateFile(legacy, target); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(out, "Moved state file to %s\n", target)
+	return target, nil
+}
+
+func moveStateFile(from, to string) error {
+	lock, err := state.Acquire(from, waitLock)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return fmt.Errorf("read state: %w", err)
+	}
+	if err := txn.WriteFile(to, data, state.FileMode); err != nil {
+		return err
+	}
+	if err := os.Remove(from); err != nil {
+		return err
+	}
+	os.Remove(state.LockPath(from))
+	return nil
 }
 
+func loadState() (*state.State, error) {
+	st, err := state.Load(getStatePath())
+	if err != nil {
+		if errors.Is(err, state.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s, run deploy first", state.ErrNotFound, getStatePath())
+		}
+		return nil, err
+	}
+	return st, nil
+}
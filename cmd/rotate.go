@@ -0,0 +1,345 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/ports"
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/rogeecn/sing-box-deploy/internal/spec"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rotateDomain  string
+	rotateTypes   []string
+	rotateUUID    bool
+	rotatePath    bool
+	rotatePort    bool
+	rotateGrace   time.Duration
+	rotateSkipVal bool
+
+	rotatePortRange    string
+	rotateExcludePorts []int
+
+	rotateSchedule     string
+	rotateScheduleWith string
+	rotateDue          bool
+)
+
+var rotateCmd = &cobra.Command{
+	Use:   "rotate [domain]",
+	Short: "Regenerate UUIDs, paths or ports of deployed inbounds and reissue subscriptions",
+	Long: `Regenerate credentials of deployed inbounds. Without --uuid, --path or
+--port both the UUID and the path are rotated. With --grace the replaced
+UUIDs stay valid as extra users until the grace period ends; they are pruned
+by the next deploy or rotate after that. Without a domain every deployed
+domain is rotated.
+
+--schedule stores the selected fields, grace and interval as the domain's
+rotation policy and installs an hourly systemd timer (or prints a crontab
+line with --schedule-with cron) running "rotate --due", which rotates only
+the domains whose policy interval has elapsed.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain := ""
+		if len(args) > 0 || rotateDomain != "" {
+			d, err := domainArg(args, rotateDomain)
+			if err != nil {
+				return err
+			}
+			domain = d
+		}
+		if rotateGrace < 0 {
+			return fmt.Errorf("--grace must not be negative")
+		}
+		rot := deployer.Rotation{
+			Keys:  rotateTypes,
+			UUID:  rotateUUID,
+			Path:  rotatePath,
+			Port:  rotatePort,
+			Grace: rotateGrace,
+		}
+		if !rot.UUID && !rot.Path && !rot.Port {
+			rot.UUID, rot.Path = true, true
+		}
+		if rotateSchedule != "" {
+			if rotateDue {
+				return fmt.Errorf("--schedule and --due cannot be combined")
+			}
+			if err := requireLocal(cmd); err != nil {
+				return err
+			}
+			return scheduleRotation(cmd, domain, rot)
+		}
+		portRange, err := ports.ParseRange(rotatePortRange)
+		if err != nil {
+			return err
+		}
+
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		targets, err := st.Select(domain)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		var rotated []*state.Deployment
+		// A failing domain leaves the domains before it rotated: their new
+		// settings are still applied and printed before the error returns.
+		var rotateErr error
+		for _, target := range targets {
+			r := rot
+			if rotateDue {
+				if target.Rotation == nil || !target.Rotation.Due(now) {
+					continue
+				}
+				r = deployer.RotationFromPolicy(*target.Rotation)
+			} else if domain == "" && len(rot.Keys) > 0 {
+				// Rotating every domain: skip domains without the inbounds.
+				r.Keys = deployedKeys(target, rot.Keys)
+				if len(r.Keys) == 0 {
+					continue
+				}
+			}
+			opts := deployer.Options{
+				Domain:        target.Domain,
+				StateFile:     getStatePath(),
+				SingBoxBinary: singBoxBin,
+				CaddyBinary:   caddyBin,
+				SkipValidate:  rotateSkipVal,
+				WaitLock:      waitLock,
+				PortRange:     portRange,
+				ExcludePorts:  rotateExcludePorts,
+			}
+			if err := onHost(&opts); err != nil {
+				rotateErr = err
+				break
+			}
+			dep, err := deployer.Rotate(opts, r)
+			if err != nil {
+				rotateErr = fmt.Errorf("%s: %w", target.Domain, err)
+				break
+			}
+			rotated = append(rotated, dep)
+		}
+		if rotateErr != nil && len(rotated) == 0 {
+			return rotateErr
+		}
+		if len(rotated) == 0 && rotateDue {
+			if structuredOutput() {
+				return writeOutput(cmd, newDeployOutput(nil, nil))
+			}
+			cmd.Println("No rotation due")
+			return nil
+		}
+		if len(rotated) == 0 {
+			return fmt.Errorf("no deployed inbounds match --type %s", strings.Join(rot.Keys, ","))
+		}
+		if err := applyServices(cmd, rotated[0].RootDir, rotated[0].CaddyFile); err != nil {
+			return errors.Join(rotateErr, err)
+		}
+		if structuredOutput() {
+			if err := writeOutput(cmd, newDeployOutput(rotated, nil)); err != nil {
+				return err
+			}
+			return rotateErr
+		}
+		for _, dep := range rotated {
+			cmd.Printf("Rotated %s\n", dep.Domain)
+			cmd.Printf("Subscriptions: %s\n", dep.SubscriptionFile)
+			for _, inbound := range dep.Inbounds {
+				cmd.Printf("# %s\n", inbound.Tag)
+				cmd.Printf("%s\n", inbound.ShareURL)
+				for _, u := range inbound.Users {
+					if u.ExpiresAt != nil {
+						cmd.Printf("  previous UUID %s accepted until %s\n", u.UUID, u.ExpiresAt.Format(time.RFC3339))
+					}
+				}
+			}
+		}
+		return rotateErr
+	},
+}
+
+// scheduleRotation stores rot as the rotation policy of domain, or of every
+// domain when empty, and installs the timer that enforces it.
+func scheduleRotation(cmd *cobra.Command, domain string, rot deployer.Rotation) error {
+	st, err := loadState()
+	if err != nil {
+		return err
+	}
+	targets, err := st.Select(domain)
+	if err != nil {
+		return err
+	}
+	var policy *state.RotationPolicy
+	if rotateSchedule != "off" {
+		interval, err := parseInterval(rotateSchedule)
+		if err != nil {
+			return err
+		}
+		keys := rot.Keys
+		if len(keys) > 0 {
+			if keys, err = spec.NormalizeKeys(keys); err != nil {
+				return err
+			}
+		}
+		policy = &state.RotationPolicy{
+			Interval:    state.Duration(interval),
+			Keys:        keys,
+			UUID:        rot.UUID,
+			Path:        rot.Path,
+			Port:        rot.Port,
+			Grace:       state.Duration(rot.Grace),
+			LastRotated: time.Now().UTC(),
+		}
+	}
+	for _, target := range targets {
+		p := policy
+		if p != nil && domain == "" && len(p.Keys) > 0 {
+			copied := *p
+			copied.Keys = deployedKeys(target, p.Keys)
+			if len(copied.Keys) == 0 {
+				continue
+			}
+			p = &copied
+		}
+		opts := deployer.Options{Domain: target.Domain, StateFile: getStatePath(), WaitLock: waitLock}
+		if err := deployer.SetRotationPolicy(opts, p); err != nil {
+			return fmt.Errorf("%s: %w", target.Domain, err)
+		}
+		target.Rotation = p
+		if p != nil {
+			cmd.Printf("%s: rotating every %s, next at %s\n", target.Domain, time.Duration(p.Interval), p.NextRotation().Format(time.RFC3339))
+		} else {
+			cmd.Printf("%s: automatic rotation disabled\n", target.Domain)
+		}
+	}
+	// Other domains may still carry a policy that needs the scheduler.
+	scheduled := 0
+	for _, dep := range st.Deployments {
+		if dep.Rotation != nil {
+			scheduled++
+		}
+	}
+
+	mgr := &service.Manager{}
+	switch rotateScheduleWith {
+	case "cron":
+		if scheduled == 0 {
+			cmd.Println("Remove the sing-box-deploy rotate line from your crontab")
+			return nil
+		}
+		command, err := rotationCommand()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "17 * * * * %s\n", service.QuoteCommand(command))
+		return nil
+	case "systemd":
+		if serviceSkip {
+			return nil
+		}
+		if scheduled == 0 {
+			return mgr.UnscheduleRotation(cmd.Context())
+		}
+		command, err := rotationCommand()
+		if err != nil {
+			return err
+		}
+		if err := mgr.ScheduleRotation(cmd.Context(), command); err != nil {
+			return err
+		}
+		cmd.Printf("Enabled %s\n", mgr.TimerPath())
+		return nil
+	default:
+		return fmt.Errorf("unknown scheduler %q (want systemd or cron)", rotateScheduleWith)
+	}
+}
+
+// rotationCommand is the unattended `rotate --due` invocation run by the
+// timer or cron, pinned to the current state file and binaries.
+func rotationCommand() ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	statePath, err := filepath.Abs(getStatePath())
+	if err != nil {
+		return nil, err
+	}
+	command := []string{exe, "--state", statePath, "--sing-box-bin", singBoxBin, "--caddy-bin", caddyBin, "rotate", "--due", "--yes"}
+	if serviceUser != "" {
+		command = append(command, "--service-user", serviceUser)
+	}
+	return command, nil
+}
+
+// parseInterval accepts Go durations plus "daily", "weekly" and a "d" day
+// suffix, e.g. "7d".
+func parseInterval(s string) (time.Duration, error) {
+	switch s {
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid interval %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+	return d, nil
+}
+
+// deployedKeys returns the keys among want that dep has deployed.
+func deployedKeys(dep *state.Deployment, want []string) []string {
+	var keys []string
+	for _, key := range want {
+		key = strings.ToLower(strings.TrimSpace(key))
+		for _, inbound := range dep.Inbounds {
+			if inbound.Key == key {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+func init() {
+	rootCmd.AddCommand(rotateCmd)
+	rotateCmd.Flags().StringVar(&rotateDomain, "domain", "", "domain to rotate (default every deployed domain)")
+	rotateCmd.Flags().StringSliceVar(&rotateTypes, "type", nil, "only rotate these inbound types (repeatable)")
+	rotateCmd.Flags().BoolVar(&rotateUUID, "uuid", false, "generate new UUIDs")
+	rotateCmd.Flags().BoolVar(&rotatePath, "path", false, "generate new transport paths")
+	rotateCmd.Flags().BoolVar(&rotatePort, "port", false, "allocate new local listen ports")
+	rotateCmd.Flags().DurationVar(&rotateGrace, "grace", 0, "keep replaced UUIDs valid for this long, e.g. 24h")
+	rotateCmd.Flags().
+		StringVar(&rotatePortRange, "port-range", ports.DefaultRange.String(), "range for newly allocated listen ports")
+	rotateCmd.Flags().IntSliceVar(&rotateExcludePorts, "exclude-port", nil, "ports never allocated to inbounds (repeatable)")
+	rotateCmd.Flags().
+		StringVar(&rotateSchedule, "schedule", "", "store a rotation policy with this interval (e.g. weekly, 7d, 72h; \"off\" removes it) and install the timer")
+	rotateCmd.Flags().StringVar(&rotateScheduleWith, "schedule-with", "systemd", "scheduler for --schedule: systemd timer or print a cron line")
+	rotateCmd.Flags().BoolVar(&rotateDue, "due", false, "only rotate domains whose rotation policy is due")
+	addServiceFlags(rotateCmd)
+	rotateCmd.Flags().
+		BoolVar(&rotateSkipVal, "skip-validate", false, "promote files without running sing-box check and caddy validate")
+}
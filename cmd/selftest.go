@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/selftest"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	selftestDomain   string
+	selftestType     string
+	selftestAddress  string
+	selftestInsecure bool
+	selftestTimeout  time.Duration
+	selftestJSON     bool
+)
+
+var selftestCmd = &cobra.Command{
+	Use:          "selftest",
+	Short:        "Dial through every deployed inbound and fetch a local test endpoint",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireLocal(cmd); err != nil {
+			return err
+		}
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		deployments, err := st.Select(selftestDomain)
+		if err != nil {
+			return err
+		}
+		var inbounds []state.Inbound
+		for _, dep := range deployments {
+			for _, inbound := range dep.Inbounds {
+				if selftestType != "" && !strings.EqualFold(inbound.Key, selftestType) {
+					continue
+				}
+				inbounds = append(inbounds, inbound)
+			}
+		}
+		if len(inbounds) == 0 {
+			cmd.Println("no matching inbounds")
+			return nil
+		}
+		tester := &selftest.Tester{
+			SingBoxBinary: singBoxBin,
+			Address:       selftestAddress,
+			Insecure:      selftestInsecure,
+			Timeout:       selftestTimeout,
+			BlockPrivate:  st.Common.Routing.BlockPrivate,
+		}
+		results, err := tester.Run(cmd.Context(), inbounds)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, res := range results {
+			if !res.OK && !res.Skipped {
+				failed++
+			}
+		}
+		if selftestJSON || structuredOutput() {
+			format := outputFormat
+			if selftestJSON {
+				format = outputJSON
+			}
+			if err := encodeOutput(cmd.OutOrStdout(), format, results); err != nil {
+				return err
+			}
+		} else {
+			for _, res := range results {
+				switch {
+				case res.OK:
+					cmd.Printf("OK   %s %.1fms\n", res.Tag, res.LatencyMS)
+				case res.Skipped:
+					cmd.Printf("SKIP %s %s\n", res.Tag, res.Error)
+				default:
+					cmd.Printf("FAIL %s %s\n", res.Tag, res.Error)
+				}
+			}
+		}
+		if failed > 0 {
+			return checkError{fmt.Sprintf("%d of %d inbounds failed", failed, len(results))}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+	selftestCmd.Flags().StringVar(&selftestDomain, "domain", "", "only test the given domain (default all)")
+	selftestCmd.Flags().StringVar(&selftestType, "type", "", "only test the given inbound key")
+	selftestCmd.Flags().
+		StringVar(&selftestAddress, "address", "127.0.0.1:443", "Caddy address the client connects to in place of the domain")
+	selftestCmd.Flags().BoolVar(&selftestInsecure, "insecure", false, "skip verification of the certificate served by Caddy")
+	selftestCmd.Flags().DurationVar(&selftestTimeout, "timeout", 15*time.Second, "timeout for each inbound")
+	selftestCmd.Flags().BoolVar(&selftestJSON, "json", false, "print results as JSON (same as --output json)")
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+	"github.com/rogeecn/sing-box-deploy/internal/runner"
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+	"github.com/spf13/cobra"
+)
+
+var (
+	serviceSkip      bool
+	serviceNoRestart bool
+	serviceUser      string
+)
+
+// addServiceFlags registers the systemd flags shared by commands that change
+// the rendered configuration.
+func addServiceFlags(c *cobra.Command) {
+	c.Flags().BoolVar(&serviceSkip, "no-service", false, "do not install systemd units or touch services")
+	c.Flags().BoolVar(&serviceNoRestart, "no-restart", false, "install and enable units but do not restart sing-box/caddy")
+	c.Flags().StringVar(&serviceUser, "service-user", "", "run sing-box as this existing user instead of a systemd DynamicUser")
+}
+
+// applyServices installs the units for root/caddyFile and the recorded log
+// settings and restarts the services unless disabled by flags.
+func applyServices(cmd *cobra.Command, root, caddyFile string) error {
+	if serviceSkip {
+		return nil
+	}
+	st, err := loadState()
+	if err != nil {
+		return err
+	}
+	fs, run, err := hostTargets()
+	if err != nil {
+		return err
+	}
+	mgr := newServiceManager(fs, run, root, caddyFile, st.Common.Log)
+	if err := mgr.Apply(cmd.Context(), !serviceNoRestart); err != nil {
+		return err
+	}
+	if serviceNoRestart {
+		cmd.Printf("Installed %s (restart skipped)\n", mgr.UnitPath())
+	} else {
+		cmd.Printf("Restarted %s and %s\n", service.SingBoxUnit, service.CaddyUnit)
+	}
+	return nil
+}
+
+// newServiceManager returns the manager of the units for root/caddyFile on
+// the machine reached through fs and run.
+func newServiceManager(fs fsys.FS, run runner.Runner, root, caddyFile string, log singbox.Log) *service.Manager {
+	return &service.Manager{
+		Runner:        run,
+		FS:            fs,
+		SingBoxBinary: singBoxBin,
+		CaddyBinary:   caddyBin,
+		RootDir:       root,
+		CaddyFile:     caddyFile,
+		User:          serviceUser,
+		Log:           log,
+	}
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var migrateCheck bool
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspect and maintain the state file",
+}
+
+var stateMigrateCmd = &cobra.Command{
+	Use:          "migrate",
+	Short:        "Upgrade the state file to the current schema version",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := getStatePath()
+		version, err := state.Check(path)
+		if err != nil {
+			if errors.Is(err, state.ErrNotFound) {
+				return fmt.Errorf("%w: %s, run deploy first", state.ErrNotFound, path)
+			}
+			return err
+		}
+		if version == state.CurrentVersion {
+			cmd.Printf("%s is at schema version %d, no migration needed\n", path, version)
+			return nil
+		}
+		if version > state.CurrentVersion {
+			return fmt.Errorf("%s is at schema version %d, newer than supported version %d", path, version, state.CurrentVersion)
+		}
+		if migrateCheck {
+			return fmt.Errorf("%s is at schema version %d and needs migration to %d", path, version, state.CurrentVersion)
+		}
+		lock, err := state.Acquire(path, waitLock)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		st, err := state.Load(path)
+		if err != nil {
+			return err
+		}
+		if err := state.Save(path, st); err != nil {
+			return err
+		}
+		cmd.Printf("Migrated %s from schema version %d to %d\n", path, version, state.CurrentVersion)
+		cmd.Printf("Backup: %s\n", state.BackupPath(path, version))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateMigrateCmd)
+	stateMigrateCmd.Flags().
+		BoolVar(&migrateCheck, "check", false, "only report whether migration is needed (exit status 1 if it is)")
+}
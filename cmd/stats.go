@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/stats"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsFile    string
+	statsNoQuery bool
+)
+
+// statsOutput is the structured result of stats.
+type statsOutput struct {
+	Version   int           `json:"version" yaml:"version"`
+	StatsFile string        `json:"stats_file" yaml:"stats_file"`
+	Since     time.Time     `json:"since" yaml:"since"`
+	UpdatedAt time.Time     `json:"updated_at" yaml:"updated_at"`
+	Total     stats.Traffic `json:"total" yaml:"total"`
+	Inbounds  []trafficView `json:"inbounds" yaml:"inbounds"`
+	Users     []trafficView `json:"users" yaml:"users"`
+}
+
+type trafficView struct {
+	Name     string `json:"name" yaml:"name"`
+	Upload   int64  `json:"upload" yaml:"upload"`
+	Download int64  `json:"download" yaml:"download"`
+	// Connections is the number of live connections, when known.
+	Connections *int `json:"connections,omitempty" yaml:"connections,omitempty"`
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show cumulative traffic per inbound and per user",
+	Long: `Query the sing-box stats APIs enabled with deploy --stats, add the new traffic
+to the stats file and print the totals. Counters in the stats file survive
+sing-box restarts; traffic between the last query and a restart is lost, so
+run stats (or exporter/enforce) regularly.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireLocal(cmd); err != nil {
+			return err
+		}
+		var snap *stats.Snapshot
+		if statsNoQuery {
+			f, err := stats.Load(getStatsPath())
+			if err != nil {
+				return err
+			}
+			snap = &stats.Snapshot{File: f}
+		} else {
+			var err error
+			if snap, err = collectStats(cmd); err != nil {
+				return err
+			}
+		}
+		out := newStatsOutput(snap)
+		if structuredOutput() {
+			return writeOutput(cmd, out)
+		}
+		cmd.Printf("Stats file: %s\n", out.StatsFile)
+		if !out.Since.IsZero() {
+			cmd.Printf("Since %s, updated %s\n", out.Since.Format(time.RFC3339), out.UpdatedAt.Format(time.RFC3339))
+		}
+		cmd.Printf("Total: up %s, down %s\n", formatBytes(out.Total.Upload), formatBytes(out.Total.Download))
+		for _, group := range []struct {
+			title string
+			views []trafficView
+		}{{"Inbounds", out.Inbounds}, {"Users", out.Users}} {
+			if len(group.views) == 0 {
+				continue
+			}
+			cmd.Printf("%s:\n", group.title)
+			for _, v := range group.views {
+				line := fmt.Sprintf("- %s up %s, down %s", v.Name, formatBytes(v.Upload), formatBytes(v.Download))
+				if v.Connections != nil {
+					line += fmt.Sprintf(", %d connections", *v.Connections)
+				}
+				cmd.Println(line)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+	addStatsFileFlag(statsCmd)
+	statsCmd.Flags().BoolVar(&statsNoQuery, "no-query", false, "print the stats file without querying sing-box")
+}
+
+// addStatsFileFlag registers --stats-file on commands that read traffic
+// counters.
+func addStatsFileFlag(c *cobra.Command) {
+	c.Flags().StringVar(&statsFile, "stats-file", "", "cumulative traffic counters (default stats.json next to the state file)")
+}
+
+func getStatsPath() string {
+	if statsFile != "" {
+		return statsFile
+	}
+	return filepath.Join(filepath.Dir(getStatePath()), "stats.json")
+}
+
+// collectStats folds the current API readings into the stats file.
+func collectStats(cmd *cobra.Command) (*stats.Snapshot, error) {
+	st, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	collector := &stats.Collector{API: st.Common.Stats, Path: getStatsPath(), Wait: true}
+	snap, err := collector.Collect(cmd.Context())
+	if errors.Is(err, stats.ErrDisabled) {
+		return nil, fmt.Errorf("%w, deploy with --stats clash and/or --stats v2ray first", err)
+	}
+	return snap, err
+}
+
+func newStatsOutput(snap *stats.Snapshot) statsOutput {
+	out := statsOutput{
+		Version:   outputVersion,
+		StatsFile: getStatsPath(),
+		Since:     snap.Since,
+		UpdatedAt: snap.UpdatedAt,
+		Total:     snap.Total,
+		Inbounds:  []trafficView{},
+		Users:     []trafficView{},
+	}
+	seen := map[string]struct{}{}
+	for _, name := range stats.Names(snap.Inbounds) {
+		view := trafficView{Name: name, Upload: snap.Inbounds[name].Upload, Download: snap.Inbounds[name].Download}
+		if snap.Connections != nil {
+			n := snap.Connections[name]
+			view.Connections = &n
+		}
+		seen[name] = struct{}{}
+		out.Inbounds = append(out.Inbounds, view)
+	}
+	// Without the V2Ray API only the live connections are known per inbound.
+	live := make([]string, 0, len(snap.Connections))
+	for name := range snap.Connections {
+		if _, ok := seen[name]; !ok {
+			live = append(live, name)
+		}
+	}
+	sort.Strings(live)
+	for _, name := range live {
+		n := snap.Connections[name]
+		out.Inbounds = append(out.Inbounds, trafficView{Name: name, Connections: &n})
+	}
+	for _, name := range stats.Names(snap.Users) {
+		out.Users = append(out.Users, trafficView{Name: name, Upload: snap.Users[name].Upload, Download: snap.Users[name].Download})
+	}
+	return out
+}
+
+// formatBytes renders n with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
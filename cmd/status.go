@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/health"
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statusDomain   string
+	statusJSON     bool
+	statusTimeout  time.Duration
+	statusInsecure bool
+)
+
+type statusReport struct {
+	StateFile string            `json:"state_file" yaml:"state_file"`
+	Services  map[string]string `json:"services" yaml:"services"`
+	Inbounds  []health.Result   `json:"inbounds" yaml:"inbounds"`
+	Healthy   bool              `json:"healthy" yaml:"healthy"`
+}
+
+var statusCmd = &cobra.Command{
+	Use:          "status",
+	Short:        "Check services, local listeners and public routes of deployed inbounds",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireLocal(cmd); err != nil {
+			return err
+		}
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		deployments, err := st.Select(statusDomain)
+		if err != nil {
+			return err
+		}
+		prober := &health.Prober{Timeout: statusTimeout, Insecure: statusInsecure}
+		report := collectStatus(cmd.Context(), getStatePath(), deployments, prober, &service.Manager{})
+		if statusJSON || structuredOutput() {
+			format := outputFormat
+			if statusJSON {
+				format = outputJSON
+			}
+			if err := encodeOutput(cmd.OutOrStdout(), format, report); err != nil {
+				return err
+			}
+		} else {
+			printStatus(cmd, report)
+		}
+		if !report.Healthy {
+			return checkError{"deployment is unhealthy"}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringVar(&statusDomain, "domain", "", "only check the given domain (default all)")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "print the report as JSON (same as --output json)")
+	statusCmd.Flags().DurationVar(&statusTimeout, "timeout", 5*time.Second, "timeout for each probe")
+	statusCmd.Flags().BoolVar(&statusInsecure, "insecure", false, "skip TLS certificate verification on the public route")
+}
+
+// collectStatus checks the services through mgr and probes every inbound
+// concurrently; the report keeps the state's order. Caddy is only checked
+// when some deployment is fronted by it.
+func collectStatus(ctx context.Context, statePath string, deployments []*state.Deployment, prober *health.Prober, mgr *service.Manager) statusReport {
+	report := statusReport{
+		StateFile: statePath,
+		Services:  map[string]string{},
+		Healthy:   true,
+	}
+	units := []string{service.SingBoxUnit}
+	for _, dep := range deployments {
+		if dep.Proxy != deployer.ProxyNone {
+			units = append(units, service.CaddyUnit)
+			break
+		}
+	}
+	for _, unit := range units {
+		active, err := mgr.ActiveState(ctx, unit)
+		if err != nil || active == "" {
+			active = "unknown"
+		}
+		report.Services[unit] = active
+		if active != "active" {
+			report.Healthy = false
+		}
+	}
+	for _, dep := range deployments {
+		report.Inbounds = append(report.Inbounds, make([]health.Result, len(dep.Inbounds))...)
+	}
+	var wg sync.WaitGroup
+	i := 0
+	for _, dep := range deployments {
+		for _, inbound := range dep.Inbounds {
+			res := &report.Inbounds[i]
+			i++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				*res = prober.Probe(ctx, dep.Domain, inbound)
+			}()
+		}
+	}
+	wg.Wait()
+	for _, res := range report.Inbounds {
+		if !res.OK() {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// units returns the checked services in a fixed order.
+func (r statusReport) units() []string {
+	var units []string
+	for _, unit := range []string{service.SingBoxUnit, service.CaddyUnit} {
+		if _, ok := r.Services[unit]; ok {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
+
+func printStatus(cmd *cobra.Command, report statusReport) {
+	cmd.Printf("State file: %s\n", report.StateFile)
+	for _, unit := range report.units() {
+		cmd.Printf("%s: %s\n", unit, report.Services[unit])
+	}
+	domain := ""
+	for _, res := range report.Inbounds {
+		if res.Domain != domain {
+			domain = res.Domain
+			cmd.Printf("Domain: %s\n", domain)
+		}
+		verdict := "OK"
+		if !res.OK() {
+			verdict = "FAIL"
+		}
+		cmd.Printf("  %-4s %s local:%s route:%s\n", verdict, res.Tag, formatCheck(res.Local), formatCheck(res.Route))
+	}
+}
+
+func formatCheck(c health.Check) string {
+	if !c.OK {
+		return "FAIL(" + c.Error + ")"
+	}
+	return fmt.Sprintf("%.1fms", c.LatencyMS)
+}
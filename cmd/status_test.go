@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/health"
+	"github.com/rogeecn/sing-box-deploy/internal/runner"
+	"github.com/rogeecn/sing-box-deploy/internal/service"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+)
+
+// unitStates answers `systemctl show --property=ActiveState` from a map.
+type unitStates map[string]string
+
+func (u unitStates) Run(ctx context.Context, name string, args ...string) (runner.Result, error) {
+	return runner.Result{Stdout: []byte(u[args[len(args)-1]] + "\n")}, nil
+}
+
+func TestCollectStatusCaddy(t *testing.T) {
+	units := unitStates{service.SingBoxUnit: "active", service.CaddyUnit: "inactive"}
+	tests := []struct {
+		name    string
+		proxies []string
+		want    map[string]string
+		healthy bool
+	}{
+		{name: "caddy fronted", proxies: []string{deployer.ProxyNone, deployer.ProxyCaddy}, want: units, healthy: false},
+		{name: "no proxy", proxies: []string{deployer.ProxyNone, deployer.ProxyNone},
+			want: map[string]string{service.SingBoxUnit: "active"}, healthy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deployments []*state.Deployment
+			for _, proxy := range tt.proxies {
+				deployments = append(deployments, &state.Deployment{Domain: "a.example.com", Proxy: proxy})
+			}
+			report := collectStatus(context.Background(), "state.json", deployments, &health.Prober{}, &service.Manager{Runner: units})
+			if !reflect.DeepEqual(report.Services, tt.want) || report.Healthy != tt.healthy {
+				t.Errorf("services %v healthy %v, want %v healthy %v", report.Services, report.Healthy, tt.want, tt.healthy)
+			}
+		})
+	}
+}
@@ -1,8 +1,6 @@
 package cmd
 
 import (
-	"errors"
-	"fmt"
 	"strings"
 
 	"github.com/rogeecn/sing-box-deploy/internal/state"
@@ -12,30 +10,69 @@ import (
 var (
 	urlTagFilter  string
 	urlTypeFilter string
+	urlDomain     string
 )
 
+// urlOutput is the structured result of url.
+type urlOutput struct {
+	Version   int        `json:"version" yaml:"version"`
+	StateFile string     `json:"state_file" yaml:"state_file"`
+	Links     []linkView `json:"links" yaml:"links"`
+	// Subscriptions maps each domain to its subscription files by format.
+	Subscriptions map[string]map[string]string `json:"subscriptions" yaml:"subscriptions"`
+}
+
+type linkView struct {
+	Domain   string `json:"domain" yaml:"domain"`
+	Key      string `json:"key" yaml:"key"`
+	Tag      string `json:"tag" yaml:"tag"`
+	ShareURL string `json:"share_url" yaml:"share_url"`
+}
+
 var urlCmd = &cobra.Command{
 	Use:   "url",
 	Short: "Print subscription URLs and optional QR codes",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		st, err := state.Load(getStatePath())
+		st, err := loadState()
+		if err != nil {
+			return err
+		}
+		deployments, err := st.Select(urlDomain)
 		if err != nil {
-			if errors.Is(err, state.ErrNotFound) {
-				return fmt.Errorf("state file not found, run deploy first")
-			}
 			return err
 		}
+		if !structuredOutput() {
+			cmd.Printf("State file: %s\n", getStatePath())
+		}
+		out := urlOutput{
+			Version:       outputVersion,
+			StateFile:     getStatePath(),
+			Links:         []linkView{},
+			Subscriptions: map[string]map[string]string{},
+		}
 		var matches []state.Inbound
 		tagFilter := strings.ToLower(urlTagFilter)
 		typeFilter := strings.ToLower(urlTypeFilter)
-		for _, inbound := range st.Inbounds {
-			if tagFilter != "" && !strings.Contains(strings.ToLower(inbound.Tag), tagFilter) {
-				continue
-			}
-			if typeFilter != "" && strings.ToLower(inbound.Key) != typeFilter {
-				continue
+		for _, dep := range deployments {
+			for _, inbound := range dep.Inbounds {
+				if tagFilter != "" && !strings.Contains(strings.ToLower(inbound.Tag), tagFilter) {
+					continue
+				}
+				if typeFilter != "" && strings.ToLower(inbound.Key) != typeFilter {
+					continue
+				}
+				matches = append(matches, inbound)
+				out.Links = append(out.Links, linkView{
+					Domain:   dep.Domain,
+					Key:      inbound.Key,
+					Tag:      inbound.Tag,
+					ShareURL: inbound.ShareURL,
+				})
 			}
-			matches = append(matches, inbound)
+			out.Subscriptions[dep.Domain] = newDeploymentView(dep).Subscriptions
+		}
+		if structuredOutput() {
+			return writeOutput(cmd, out)
 		}
 		if len(matches) == 0 {
 			cmd.Println("no matching inbounds")
@@ -52,4 +89,5 @@ func init() {
 	rootCmd.AddCommand(urlCmd)
 	urlCmd.Flags().StringVar(&urlTagFilter, "tag", "", "filter by inbound tag substring")
 	urlCmd.Flags().StringVar(&urlTypeFilter, "type", "", "filter by inbound key (e.g. vless-ws-tls)")
+	urlCmd.Flags().StringVar(&urlDomain, "domain", "", "only show links for the given domain (default all)")
 }
@@ -2,9 +2,17 @@ module github.com/rogeecn/sing-box-deploy
 
 go 1.25.3
 
-require github.com/spf13/cobra v1.10.1
+require (
+	github.com/pkg/sftp v1.13.11
+	github.com/spf13/cobra v1.10.1
+	golang.org/x/crypto v0.55.0
+	golang.org/x/term v0.45.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/spf13/pflag v1.0.9 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 )
@@ -0,0 +1,72 @@
+package deployer
+
+import (
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
+)
+
+// UpdateCommon applies update to the host-wide settings recorded in state
+// and re-renders 00_common.json in the root directory of every deployment,
+// or in opts.RootDir when nothing is deployed yet. Inbounds, the Caddyfile
+// and subscriptions are left alone. Only the root, state, binary and
+// validation options are used.
+func UpdateCommon(opts Options, update func(*singbox.Common) error) (*state.State, error) {
+	opts.applyDefaults()
+	lock, err := state.Acquire(opts.StateFile, opts.WaitLock)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	st, err := state.Load(opts.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHost(opts, st); err != nil {
+		return nil, err
+	}
+	if err := update(&st.Common); err != nil {
+		return nil, err
+	}
+	if err := st.Common.Validate(); err != nil {
+		return nil, err
+	}
+	if err := st.Common.CheckFiles(opts.FS); err != nil {
+		return nil, err
+	}
+
+	tx := txn.NewOn(opts.FS)
+	defer tx.Rollback()
+	for _, root := range rootDirs(st, opts.RootDir) {
+		if err := writeSingBoxConfig(tx, root, st); err != nil {
+			return nil, err
+		}
+		if err := validateStaged(opts, root, tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := commit(tx, opts.StateFile, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// rootDirs returns the distinct root directories of the deployments in
+// domain order, or fallback when there are none.
+func rootDirs(st *state.State, fallback string) []string {
+	var roots []string
+	seen := map[string]struct{}{}
+	for _, domain := range st.Domains() {
+		root := st.Deployments[domain].RootDir
+		if _, ok := seen[root]; ok {
+			continue
+		}
+		seen[root] = struct{}{}
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 && fallback != "" {
+		roots = append(roots, fallback)
+	}
+	return roots
+}
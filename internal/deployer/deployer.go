@@ -1,18 +1,23 @@
 package deployer
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+	"github.com/rogeecn/sing-box-deploy/internal/ports"
+	"github.com/rogeecn/sing-box-deploy/internal/runner"
 	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
 	"github.com/rogeecn/sing-box-deploy/internal/spec"
 	"github.com/rogeecn/sing-box-deploy/internal/state"
 	"github.com/rogeecn/sing-box-deploy/internal/templates"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
 )
 
 type Options struct {
@@ -25,8 +30,72 @@ type Options struct {
 	SubscriptionDir string
 	StateFile       string
 	SingBoxBinary   string
+	CaddyBinary     string
 	TLSKeyPath      string
 	TLSCertPath     string
+
+	// Runner executes sing-box and caddy and FS receives the rendered
+	// files; both default to this machine. The state file is always local.
+	Runner runner.Runner
+	FS     fsys.FS
+	// Host names the machine Runner and FS reach, empty for this one. It is
+	// recorded in state so that one state file never drives two hosts.
+	Host string
+	// SkipValidate promotes rendered files without running the validators.
+	SkipValidate bool
+
+	// PortRange bounds randomly allocated listen ports; ExcludePorts are never
+	// handed out and PinnedPorts fixes the port of an inbound key.
+	PortRange    ports.Range
+	ExcludePorts []int
+	PinnedPorts  map[string]int
+
+	// WaitLock blocks on a concurrently held state lock instead of failing.
+	WaitLock bool
+
+	// MaxEarlyData and EarlyDataHeaderName apply to WebSocket inbounds; a zero
+	// MaxEarlyData disables early data.
+	MaxEarlyData        int
+	EarlyDataHeaderName string
+
+	// KeepExisting reuses the UUID, path, port and users an inbound already
+	// has in state instead of generating new ones.
+	KeepExisting bool
+	// Overrides customise individual inbounds by key.
+	Overrides map[string]InboundOverride
+	// TLSMode is "acme" (default) or "internal".
+	TLSMode string
+	// Proxy is "caddy" (default) or "none" to leave the front proxy alone.
+	Proxy string
+	// SubscriptionFormats lists the formats written to SubscriptionDir;
+	// defaults to the text format.
+	SubscriptionFormats []string
+	// Common replaces the host-wide settings recorded in state when set.
+	Common *singbox.Common
+	// Routing replaces only the routing section of the host-wide settings.
+	Routing *singbox.Routing
+	// DNS replaces only the dns section of the host-wide settings.
+	DNS *singbox.DNS
+	// Stats replaces only the experimental API settings.
+	Stats *singbox.Stats
+	// Log replaces only the log settings.
+	Log *singbox.Log
+
+	// rotation is set by Rotate.
+	rotation *Rotation
+}
+
+// InboundOverride customises a single inbound. Zero fields keep the
+// generated or existing value; ports are pinned through PinnedPorts.
+type InboundOverride struct {
+	Path string
+	Host string
+	// UUID replaces the credential of an inbound without Users.
+	UUID  string
+	Users []spec.User
+	// MaxEarlyData overrides the WebSocket early data size when non-nil.
+	MaxEarlyData        *int
+	EarlyDataHeaderName string
 }
 
 func (o *Options) validate() error {
@@ -45,8 +114,28 @@ func (o *Options) validate() error {
 	if o.StateFile == "" {
 		return fmt.Errorf("state file path is required")
 	}
-	if o.SingBoxBinary == "" {
-		o.SingBoxBinary = "sing-box"
+	o.applyDefaults()
+	switch o.TLSMode {
+	case "":
+		o.TLSMode = TLSModeACME
+	case TLSModeACME, TLSModeInternal:
+	default:
+		return fmt.Errorf("unknown tls mode %q", o.TLSMode)
+	}
+	switch o.Proxy {
+	case "":
+		o.Proxy = ProxyCaddy
+	case ProxyCaddy, ProxyNone:
+	default:
+		return fmt.Errorf("unknown proxy backend %q", o.Proxy)
+	}
+	if len(o.SubscriptionFormats) == 0 {
+		o.SubscriptionFormats = []string{share.FormatText}
+	}
+	for _, format := range o.SubscriptionFormats {
+		if !share.ValidFormat(format) {
+			return fmt.Errorf("unknown subscription format %q", format)
+		}
 	}
 	if o.TLSKeyPath == "" {
 		o.TLSKeyPath = filepath.Join(o.RootDir, "tls.key")
@@ -57,27 +146,127 @@ func (o *Options) validate() error {
 	return nil
 }
 
-// Run executes the deployment workflow and returns the resulting state.
-func Run(opts Options) (*state.State, error) {
+// TLS modes and proxy backends accepted by Options.
+const (
+	TLSModeACME     = "acme"
+	TLSModeInternal = "internal"
+
+	ProxyCaddy = "caddy"
+	ProxyNone  = "none"
+)
+
+func (o *Options) applyDefaults() {
+	if o.SingBoxBinary == "" {
+		o.SingBoxBinary = "sing-box"
+	}
+	if o.CaddyBinary == "" {
+		o.CaddyBinary = "caddy"
+	}
+	if o.Runner == nil {
+		o.Runner = runner.Local{}
+	}
+	if o.FS == nil {
+		o.FS = fsys.Local{}
+	}
+}
+
+// checkHost makes sure st describes opts.Host and records it for a state
+// without deployments.
+func checkHost(opts Options, st *state.State) error {
+	if st.Host == opts.Host {
+		return nil
+	}
+	if len(st.Deployments) > 0 {
+		describes := "this machine"
+		if st.Host != "" {
+			describes = st.Host
+		}
+		target := "this machine"
+		if opts.Host != "" {
+			target = opts.Host
+		}
+		return fmt.Errorf("the state file describes %s, not %s; use a separate --state per host", describes, target)
+	}
+	st.Host = opts.Host
+	return nil
+}
+
+// Run executes the deployment workflow for opts.Domain and returns the
+// resulting deployment. Other domains recorded in the state file are kept.
+func Run(opts Options) (*state.Deployment, error) {
 	if err := opts.validate(); err != nil {
 		return nil, err
 	}
+	if _, err := spec.NormalizeKeys(opts.InboundKeys); err != nil {
+		return nil, err
+	}
 
-	keys, err := spec.NormalizeKeys(opts.InboundKeys)
+	lock, err := state.Acquire(opts.StateFile, opts.WaitLock)
 	if err != nil {
 		return nil, err
 	}
+	defer lock.Release()
 
-	inbounds := make(map[string]spec.InboundSpec, len(keys))
-	for _, key := range keys {
-		specData, err := spec.BuildSpec(key, opts.Domain)
-		if err != nil {
+	st, err := state.Load(opts.StateFile)
+	if err != nil {
+		if !errors.Is(err, state.ErrNotFound) {
 			return nil, err
 		}
-		if opts.ProfileName != "" {
-			specData.Name = opts.ProfileName
+		st = state.New()
+	}
+	return deploy(opts, st)
+}
+
+// deploy renders opts.Domain into st and commits the result. The caller
+// holds the state lock.
+func deploy(opts Options, st *state.State) (*state.Deployment, error) {
+	if err := checkHost(opts, st); err != nil {
+		return nil, err
+	}
+	keys, err := spec.NormalizeKeys(opts.InboundKeys)
+	if err != nil {
+		return nil, err
+	}
+	previous := st.Deployments[opts.Domain]
+
+	alloc, err := newPortAllocator(opts, st, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	inbounds, err := buildInbounds(opts, previous, alloc, keys)
+	if err != nil {
+		return nil, err
+	}
+	secret := st.Common.Stats.Secret
+	if opts.Common != nil {
+		st.Common = *opts.Common
+	}
+	if opts.Routing != nil {
+		st.Common.Routing = *opts.Routing
+	}
+	if opts.DNS != nil {
+		st.Common.DNS = *opts.DNS
+	}
+	if opts.Stats != nil {
+		st.Common.Stats = *opts.Stats
+	}
+	if opts.Log != nil {
+		st.Common.Log = *opts.Log
+	}
+	if s := &st.Common.Stats; s.ClashAPI != "" && s.Secret == "" {
+		// Keep the secret stable across deploys so clients of the API
+		// do not need reconfiguring.
+		s.Secret = secret
+		if s.Secret == "" {
+			s.Secret = spec.NewUUID()
 		}
-		inbounds[key] = specData
+	}
+	if err := st.Common.Validate(); err != nil {
+		return nil, err
+	}
+	if err := st.Common.CheckFiles(opts.FS); err != nil {
+		return nil, err
 	}
 
 	data := templates.Data{
@@ -93,73 +282,237 @@ func Run(opts Options) (*state.State, error) {
 		return nil, err
 	}
 
-	if err := writeInboundFiles(opts.RootDir, inbounds, rendered); err != nil {
-		return nil, err
-	}
+	tx := txn.NewOn(opts.FS)
+	defer tx.Rollback()
 
-	if err := writeSingBoxConfig(opts.RootDir); err != nil {
+	if err := writeInboundFiles(tx, opts.RootDir, inbounds, rendered); err != nil {
 		return nil, err
 	}
 
-	if err := ensureTLSKeyPair(opts); err != nil {
-		return nil, err
+	if previous != nil {
+		removeStaleInbounds(tx, previous, opts.RootDir, inbounds)
 	}
 
-	if err := writeCaddyFile(opts.CaddyFile, data); err != nil {
+	if err := ensureTLSKeyPair(opts); err != nil {
 		return nil, err
 	}
 
 	shareLinks := make([]state.Inbound, 0, len(keys))
-	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("# Subscriptions for %s\n\n", opts.Domain))
-
 	for _, key := range keys {
 		specData := inbounds[key]
 		link, err := share.BuildLink(specData, opts.Domain)
 		if err != nil {
 			return nil, err
 		}
-		shareLinks = append(shareLinks, state.Inbound{
-			Key:        key,
-			Tag:        specData.Tag,
-			Name:       specData.Name,
-			Protocol:   specData.Protocol,
-			Transport:  specData.Transport,
-			ListenPort: specData.ListenPort,
-			UUID:       specData.UUID,
-			Path:       specData.Path,
-			Host:       specData.Host,
-			ShareURL:   link,
-		})
-		builder.WriteString(fmt.Sprintf("[%s]\n%s\n\n", specData.Tag, link))
+		shareLinks = append(shareLinks, inboundState(specData, link))
+	}
+
+	deployment := &state.Deployment{
+		Domain:      opts.Domain,
+		Email:       opts.Email,
+		RootDir:     opts.RootDir,
+		CaddyFile:   opts.CaddyFile,
+		Inbounds:    shareLinks,
+		LastUpdated: time.Now().UTC(),
+		ProfileName: opts.ProfileName,
+		TLSMode:     opts.TLSMode,
+		Proxy:       opts.Proxy,
+	}
+	if previous != nil && previous.Rotation != nil {
+		policy := *previous.Rotation
+		if opts.rotation != nil {
+			policy.LastRotated = deployment.LastUpdated
+		}
+		deployment.Rotation = &policy
+	}
+	if err := writeSubscriptions(tx, opts.SubscriptionDir, opts.SubscriptionFormats, deployment); err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		removeStaleSubscriptions(tx, previous, deployment)
+	}
+	st.Deployments[opts.Domain] = deployment
+	if err := writeSingBoxConfig(tx, opts.RootDir, st); err != nil {
+		return nil, err
 	}
 
-	subPath, err := writeSubscription(opts.SubscriptionDir, opts.Domain, builder.String())
+	caddyFiles := []string{opts.CaddyFile}
+	if opts.Proxy != ProxyNone || (previous != nil && previous.Proxy != ProxyNone) {
+		if err := writeCaddyFile(tx, opts.CaddyFile, caddySites(st, opts.CaddyFile)); err != nil {
+			return nil, err
+		}
+	}
+	if previous != nil && previous.CaddyFile != opts.CaddyFile && previous.Proxy != ProxyNone {
+		if err := writeCaddyFile(tx, previous.CaddyFile, caddySites(st, previous.CaddyFile)); err != nil {
+			return nil, err
+		}
+		caddyFiles = append(caddyFiles, previous.CaddyFile)
+	}
+
+	if err := validateStaged(opts, opts.RootDir, tx, caddyFiles...); err != nil {
+		return nil, err
+	}
+	if err := commit(tx, opts.StateFile, st); err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// Remove deletes the files rendered for opts.Domain, re-renders its
+// Caddyfile without the site block and drops the deployment from the state
+// file. Only the domain, state, binary and validation options are used.
+func Remove(opts Options) (*state.Deployment, error) {
+	if opts.Domain == "" {
+		return nil, fmt.Errorf("domain is required")
+	}
+	opts.applyDefaults()
+	lock, err := state.Acquire(opts.StateFile, opts.WaitLock)
 	if err != nil {
 		return nil, err
 	}
+	defer lock.Release()
 
-	finalState := &state.State{
-		Domain:           opts.Domain,
-		Email:            opts.Email,
-		RootDir:          opts.RootDir,
-		CaddyFile:        opts.CaddyFile,
-		SubscriptionFile: subPath,
-		Inbounds:         shareLinks,
+	st, err := state.Load(opts.StateFile)
+	if err != nil {
+		return nil, err
 	}
-	if err := state.Save(opts.StateFile, finalState); err != nil {
+	if err := checkHost(opts, st); err != nil {
 		return nil, err
 	}
-	return finalState, nil
+	deps, err := st.Select(opts.Domain)
+	if err != nil {
+		return nil, err
+	}
+	dep := deps[0]
+
+	tx := txn.NewOn(opts.FS)
+	defer tx.Rollback()
+	removeStaleInbounds(tx, dep, dep.RootDir, nil)
+	removeStaleSubscriptions(tx, dep, nil)
+	delete(st.Deployments, opts.Domain)
+	if err := writeSingBoxConfig(tx, dep.RootDir, st); err != nil {
+		return nil, err
+	}
+	if dep.Proxy != ProxyNone {
+		if err := writeCaddyFile(tx, dep.CaddyFile, caddySites(st, dep.CaddyFile)); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateStaged(opts, dep.RootDir, tx, dep.CaddyFile); err != nil {
+		return nil, err
+	}
+	if err := commit(tx, opts.StateFile, st); err != nil {
+		return nil, err
+	}
+	return dep, nil
+}
+
+// commit renames the staged files into place and then the updated state
+// file, which is staged separately because it stays on this machine when tx
+// targets a remote host.
+func commit(tx *txn.Tx, stateFile string, st *state.State) error {
+	payload, err := state.Encode(st)
+	if err != nil {
+		return err
+	}
+	local := txn.New()
+	defer local.Rollback()
+	if err := local.WriteFile(stateFile, payload, state.FileMode); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return local.Commit()
+}
+
+// newPortAllocator reserves the ports of every other deployment and the
+// sockets listening on the target host, and applies the pins for keys. A
+// pin may reuse the port the same inbound already owns even though the
+// running sing-box still has it bound.
+func newPortAllocator(opts Options, st *state.State, keys []string) (*ports.Allocator, error) {
+	bound, err := ports.ListeningPorts(opts.FS)
+	if err != nil {
+		return nil, err
+	}
+	alloc, err := ports.New(opts.PortRange, opts.ExcludePorts, bound)
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range st.Deployments {
+		if dep.Domain == opts.Domain {
+			continue
+		}
+		for _, inbound := range dep.Inbounds {
+			alloc.Reserve(inbound.ListenPort, inbound.Tag)
+		}
+	}
+	selected := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		selected[key] = struct{}{}
+	}
+	for key, port := range opts.PinnedPorts {
+		if _, ok := selected[key]; !ok {
+			return nil, fmt.Errorf("port pinned for %s, which is not being deployed", key)
+		}
+		if previous := st.Deployments[opts.Domain]; previous != nil {
+			for _, inbound := range previous.Inbounds {
+				if inbound.Key == key && inbound.ListenPort == port {
+					alloc.Release(port)
+				}
+			}
+		}
+		if err := alloc.Pin(port, key); err != nil {
+			return nil, err
+		}
+	}
+	return alloc, nil
 }
 
-func writeInboundFiles(root string, specs map[string]spec.InboundSpec, rendered map[string][]byte) error {
-	if err := os.MkdirAll(root, 0o750); err != nil {
+// caddySites collects the site blocks of every deployment sharing caddyFile
+// that is fronted by Caddy.
+func caddySites(st *state.State, caddyFile string) []templates.Data {
+	var sites []templates.Data
+	for _, dep := range st.Deployments {
+		if dep.CaddyFile != caddyFile || dep.Proxy == ProxyNone {
+			continue
+		}
+		inbounds := make(map[string]spec.InboundSpec, len(dep.Inbounds))
+		for _, inbound := range dep.Inbounds {
+			inbounds[inbound.Key] = specFromState(dep.Domain, inbound)
+		}
+		sites = append(sites, templates.Data{
+			Domain:   dep.Domain,
+			Email:    dep.Email,
+			TLSMode:  dep.TLSMode,
+			Inbounds: inbounds,
+		})
+	}
+	return sites
+}
+
+// removeStaleInbounds schedules removal of inbound files of dep that are not
+// part of keep.
+func removeStaleInbounds(tx *txn.Tx, dep *state.Deployment, root string, keep map[string]spec.InboundSpec) {
+	for _, inbound := range dep.Inbounds {
+		if current, ok := keep[inbound.Key]; ok && current.Tag == inbound.Tag && dep.RootDir == root {
+			continue
+		}
+		tx.Remove(inboundFilePath(dep.RootDir, inbound.Tag+".json"))
+	}
+}
+
+func inboundFilePath(root, fileName string) string {
+	return filepath.Join(root, "02_inbounds_"+fileName)
+}
+
+func writeInboundFiles(tx *txn.Tx, root string, specs map[string]spec.InboundSpec, rendered map[string][]byte) error {
+	if err := tx.MkdirAll(root, 0o750); err != nil {
 		return err
 	}
 	for key, content := range rendered {
 		specData := specs[key]
-		file := filepath.Join(root, "02_inbounds_"+specData.FileName)
+		file := inboundFilePath(root, specData.FileName)
 		var inbound map[string]any
 		if err := json.Unmarshal(content, &inbound); err != nil {
 			return fmt.Errorf("decode inbound %s: %w", key, err)
@@ -171,80 +524,68 @@ func writeInboundFiles(root string, specs map[string]spec.InboundSpec, rendered
 		if err != nil {
 			return fmt.Errorf("wrap inbound %s: %w", key, err)
 		}
-		if err := os.WriteFile(file, append(encoded, '\n'), 0o640); err != nil {
+		if err := tx.WriteFile(file, append(encoded, '\n'), 0o640); err != nil {
 			return fmt.Errorf("write %s: %w", file, err)
 		}
 	}
 	return nil
 }
 
-func writeSingBoxConfig(root string) error {
-	configPath := filepath.Join(root, "00_common.json")
-	payload := map[string]any{
-		"log": map[string]any{
-			"level":     "info",
-			"timestamp": true,
-			"output":    "/var/log/sing-box/sing-box.log",
-		},
-		"outbounds": []map[string]any{
-			{
-				"type": "direct",
-				"tag":  "direct",
-			},
-			{
-				"type": "block",
-				"tag":  "block",
-			},
-		},
-		"route": map[string]any{
-			"final": "direct",
-		},
-	}
-
-	data, err := json.MarshalIndent(payload, "", "  ")
+// writeSingBoxConfig renders 00_common.json into root with the V2Ray API
+// counting the inbounds and users deployed there.
+func writeSingBoxConfig(tx *txn.Tx, root string, st *state.State) error {
+	var counters singbox.Counters
+	for _, dep := range st.Deployments {
+		if dep.RootDir != root {
+			continue
+		}
+		for _, inbound := range dep.Inbounds {
+			counters.Inbounds = append(counters.Inbounds, inbound.Tag)
+			for _, u := range inbound.Users {
+				counters.Users = append(counters.Users, u.Name)
+			}
+		}
+	}
+	data, err := st.Common.Render(counters)
 	if err != nil {
-		return fmt.Errorf("marshal config: %w", err)
+		return err
 	}
-	if err := os.MkdirAll(root, 0o750); err != nil {
+	if err := tx.MkdirAll(root, 0o750); err != nil {
 		return err
 	}
-	return os.WriteFile(configPath, append(data, '\n'), 0o640)
+	return tx.WriteFile(filepath.Join(root, "00_common.json"), data, 0o640)
 }
 
+// ensureTLSKeyPair generates the self-signed key pair when missing. The files
+// are written immediately rather than staged so that validation can load them.
 func ensureTLSKeyPair(opts Options) error {
 	keyPath := opts.TLSKeyPath
 	certPath := opts.TLSCertPath
 	certDir := filepath.Dir(keyPath)
-	if _, err := os.Stat(keyPath); err == nil {
-		if _, err := os.Stat(certPath); err == nil {
+	if _, err := opts.FS.Stat(keyPath); err == nil {
+		if _, err := opts.FS.Stat(certPath); err == nil {
 			return nil
 		}
 	}
-	if err := os.MkdirAll(certDir, 0o750); err != nil {
+	if err := opts.FS.MkdirAll(certDir, 0o750); err != nil {
 		return fmt.Errorf("create cert dir: %w", err)
 	}
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(opts.SingBoxBinary, "generate", "tls-keypair", opts.Domain, "-m", "1024")
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("generate tls keypair: %w (%s)", err, strings.TrimSpace(stderr.String()))
-	}
-	keyPEM, err := extractPEM(stdout.String(), "PRIVATE KEY")
+	res, err := opts.Runner.Run(context.Background(), opts.SingBoxBinary, "generate", "tls-keypair", opts.Domain, "-m", "1024")
 	if err != nil {
-		return err
+		return fmt.Errorf("generate tls keypair: %w (%s)", err, strings.TrimSpace(string(res.Stderr)))
 	}
-	certPEM, err := extractPEM(stdout.String(), "CERTIFICATE")
+	keyPEM, err := extractPEM(string(res.Stdout), "PRIVATE KEY")
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(certDir, 0o750); err != nil {
+	certPEM, err := extractPEM(string(res.Stdout), "CERTIFICATE")
+	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(keyPath, []byte(keyPEM), 0o600); err != nil {
+	if err := txn.WriteFileOn(opts.FS, keyPath, []byte(keyPEM), 0o600); err != nil {
 		return err
 	}
-	if err := os.WriteFile(certPath, []byte(certPEM), 0o644); err != nil {
+	if err := txn.WriteFileOn(opts.FS, certPath, []byte(certPEM), 0o644); err != nil {
 		return err
 	}
 	return nil
@@ -266,24 +607,62 @@ func extractPEM(raw, header string) (string, error) {
 	return strings.TrimSpace(block) + "\n", nil
 }
 
-func writeCaddyFile(path string, data templates.Data) error {
-	content, err := templates.RenderCaddy(data)
+func writeCaddyFile(tx *txn.Tx, path string, sites []templates.Data) error {
+	content, err := templates.RenderCaddy(sites)
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	if err := tx.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return tx.WriteFile(path, append(content, '\n'), 0o640)
+}
+
+// writeSubscriptions renders every format for dep and records the files.
+func writeSubscriptions(tx *txn.Tx, dir string, formats []string, dep *state.Deployment) error {
+	if err := tx.MkdirAll(dir, 0o750); err != nil {
 		return err
 	}
-	return os.WriteFile(path, append(content, '\n'), 0o640)
+	entries := make([]share.Entry, 0, len(dep.Inbounds))
+	for _, inbound := range dep.Inbounds {
+		entries = append(entries, share.Entry{Name: inbound.Tag, Link: inbound.ShareURL})
+	}
+	dep.SubscriptionFiles = make(map[string]string, len(formats))
+	for _, format := range formats {
+		content, err := share.RenderSubscription(format, dep.Domain, entries)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, share.FileName(dep.Domain, format))
+		if err := tx.WriteFile(target, content, 0o640); err != nil {
+			return err
+		}
+		dep.SubscriptionFiles[format] = target
+		if dep.SubscriptionFile == "" || format == share.FormatText {
+			dep.SubscriptionFile = target
+		}
+	}
+	return nil
 }
 
-func writeSubscription(dir, domain, body string) (string, error) {
-	if err := os.MkdirAll(dir, 0o750); err != nil {
-		return "", err
+// removeStaleSubscriptions schedules removal of subscription files of
+// previous that current no longer writes.
+func removeStaleSubscriptions(tx *txn.Tx, previous, current *state.Deployment) {
+	keep := map[string]struct{}{}
+	if current != nil {
+		for _, path := range current.SubscriptionFiles {
+			keep[path] = struct{}{}
+		}
 	}
-	target := filepath.Join(dir, fmt.Sprintf("%s.txt", domain))
-	if err := os.WriteFile(target, []byte(body), 0o640); err != nil {
-		return "", err
+	files := []string{previous.SubscriptionFile}
+	for _, path := range previous.SubscriptionFiles {
+		files = append(files, path)
+	}
+	for _, path := range files {
+		if _, ok := keep[path]; ok || path == "" {
+			continue
+		}
+		keep[path] = struct{}{}
+		tx.Remove(path)
 	}
-	return target, nil
 }
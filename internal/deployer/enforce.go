@@ -0,0 +1,103 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+)
+
+// Reasons recorded in state.User.Disabled.
+const (
+	DisabledQuota   = "quota"
+	DisabledExpired = "expired"
+)
+
+// UserChange is a user disabled or re-enabled by Enforce.
+type UserChange struct {
+	Domain string `json:"domain" yaml:"domain"`
+	Tag    string `json:"tag" yaml:"tag"`
+	User   string `json:"user" yaml:"user"`
+	// Reason is why the user is now disabled; empty when re-enabled.
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// Enforce disables users past ValidUntil or over their quota and re-enables
+// users that no longer are, e.g. after the quota period reset, then
+// re-renders every domain with a change. usage returns the bytes a user name
+// transferred in the current period; it may be nil when no user has a
+// quota. Only the state, binary, port range and validation options of opts
+// are used. Domains are committed one at a time, so when a domain fails the
+// changes already committed for earlier domains are returned with the error.
+func Enforce(opts Options, usage func(name string) int64, now time.Time) ([]UserChange, error) {
+	if opts.StateFile == "" {
+		return nil, fmt.Errorf("state file path is required")
+	}
+	lock, err := state.Acquire(opts.StateFile, opts.WaitLock)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	st, err := state.Load(opts.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	var changes []UserChange
+	for _, domain := range st.Domains() {
+		// Each deploy commits the whole state, so only the domain being
+		// re-rendered may carry its changes; a later domain that fails
+		// must not be recorded as enforced.
+		dep, domainChanges := enforceDeployment(st.Deployments[domain], usage, now)
+		if len(domainChanges) == 0 {
+			continue
+		}
+		depOpts := optionsFromDeployment(opts, dep)
+		depOpts.Domain = domain
+		if err := depOpts.validate(); err != nil {
+			return changes, err
+		}
+		previous := st.Deployments[domain]
+		st.Deployments[domain] = dep
+		if _, err := deploy(depOpts, st); err != nil {
+			st.Deployments[domain] = previous
+			return changes, fmt.Errorf("%s: %w", domain, err)
+		}
+		changes = append(changes, domainChanges...)
+	}
+	return changes, nil
+}
+
+// enforceDeployment returns a copy of dep with the users disabled or
+// re-enabled at now, and the changes made. dep itself is not modified.
+func enforceDeployment(dep *state.Deployment, usage func(string) int64, now time.Time) (*state.Deployment, []UserChange) {
+	next := *dep
+	next.Inbounds = make([]state.Inbound, len(dep.Inbounds))
+	var changes []UserChange
+	for i, inbound := range dep.Inbounds {
+		inbound.Users = append([]state.User(nil), inbound.Users...)
+		for j := range inbound.Users {
+			u := &inbound.Users[j]
+			reason := disableReason(*u, usage, now)
+			if reason == u.Disabled {
+				continue
+			}
+			u.Disabled = reason
+			changes = append(changes, UserChange{Domain: dep.Domain, Tag: inbound.Tag, User: u.Name, Reason: reason})
+		}
+		next.Inbounds[i] = inbound
+	}
+	return &next, changes
+}
+
+// disableReason returns why u should be disabled at now, or "".
+func disableReason(u state.User, usage func(string) int64, now time.Time) string {
+	switch {
+	case u.ValidUntil != nil && !now.Before(*u.ValidUntil):
+		return DisabledExpired
+	case u.Quota > 0 && usage != nil && usage(u.Name) >= u.Quota:
+		return DisabledQuota
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,244 @@
+package deployer
+
+import (
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/ports"
+	"github.com/rogeecn/sing-box-deploy/internal/spec"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+)
+
+// buildInbounds produces the specs for keys. Existing inbounds are reused
+// when opts.KeepExisting is set; ports are allocated only once every kept or
+// pinned port has been reserved.
+func buildInbounds(opts Options, previous *state.Deployment, alloc *ports.Allocator, keys []string) (map[string]spec.InboundSpec, error) {
+	now := time.Now().UTC()
+	existing := map[string]state.Inbound{}
+	if previous != nil && opts.KeepExisting {
+		for _, inbound := range previous.Inbounds {
+			existing[inbound.Key] = inbound
+		}
+	}
+
+	inbounds := make(map[string]spec.InboundSpec, len(keys))
+	var pending []string
+	for _, key := range keys {
+		specData, err := spec.BuildSpec(key, opts.Domain)
+		if err != nil {
+			return nil, err
+		}
+		prev, kept := existing[key]
+		if kept {
+			specData.UUID = prev.UUID
+			specData.Path = prev.Path
+			specData.Host = prev.Host
+			specData.Users = usersToSpec(activeUsers(prev.Users, now))
+		}
+		if opts.ProfileName != "" {
+			specData.Name = opts.ProfileName
+		}
+		if specData.Transport == "ws" {
+			specData.MaxEarlyData = opts.MaxEarlyData
+			specData.EarlyDataHeaderName = ""
+			if opts.MaxEarlyData > 0 {
+				specData.EarlyDataHeaderName = opts.EarlyDataHeaderName
+				if specData.EarlyDataHeaderName == "" {
+					specData.EarlyDataHeaderName = spec.DefaultEarlyDataHeaderName
+				}
+			}
+		}
+		applyOverride(&specData, opts.Overrides[key], prev.Users, now)
+		rotate := opts.rotation.covers(key)
+		if kept && rotate {
+			opts.rotation.apply(&specData, now)
+		}
+
+		switch port, pinned := opts.PinnedPorts[key]; {
+		case pinned:
+			specData.ListenPort = port
+		case kept && rotate && opts.rotation.Port:
+			// Keep the old port out of reach so the new one differs.
+			alloc.Reserve(prev.ListenPort, specData.Tag+" (retired)")
+			pending = append(pending, key)
+		case kept:
+			specData.ListenPort = prev.ListenPort
+			alloc.Reserve(prev.ListenPort, specData.Tag)
+		default:
+			pending = append(pending, key)
+		}
+		inbounds[key] = specData
+	}
+	for _, key := range pending {
+		specData := inbounds[key]
+		port, err := alloc.Allocate(specData.Tag)
+		if err != nil {
+			return nil, err
+		}
+		specData.ListenPort = port
+		inbounds[key] = specData
+	}
+	return inbounds, nil
+}
+
+// applyOverride merges o into s. Users without a UUID keep the UUID of the
+// same-named user in previous, or get a fresh one, and keep the state set by
+// enforce. Credentials of previous still in their rotation grace period are
+// carried over.
+func applyOverride(s *spec.InboundSpec, o InboundOverride, previous []state.User, now time.Time) {
+	if o.Path != "" {
+		s.Path = o.Path
+	}
+	if o.Host != "" {
+		s.Host = o.Host
+	}
+	if s.Transport == "ws" && o.MaxEarlyData != nil {
+		s.MaxEarlyData = *o.MaxEarlyData
+		s.EarlyDataHeaderName = ""
+		if s.MaxEarlyData > 0 {
+			s.EarlyDataHeaderName = spec.DefaultEarlyDataHeaderName
+		}
+	}
+	if s.Transport == "ws" && o.EarlyDataHeaderName != "" && s.MaxEarlyData > 0 {
+		s.EarlyDataHeaderName = o.EarlyDataHeaderName
+	}
+	if o.UUID != "" && len(o.Users) == 0 {
+		// Keep credentials in their grace period next to the pinned one.
+		var retired []spec.User
+		for _, u := range s.Users {
+			if u.ExpiresAt != nil && u.UUID != o.UUID {
+				retired = append(retired, u)
+			}
+		}
+		s.UUID = o.UUID
+		s.Users = nil
+		if len(retired) > 0 {
+			s.Users = append([]spec.User{{UUID: o.UUID}}, retired...)
+		}
+	}
+	if len(o.Users) > 0 {
+		known := map[string]string{}
+		disabled := map[string]string{}
+		for _, u := range previous {
+			if u.ExpiresAt == nil {
+				known[u.Name] = u.UUID
+			}
+			disabled[u.UUID] = u.Disabled
+		}
+		users := make([]spec.User, 0, len(o.Users))
+		listed := map[string]struct{}{}
+		for _, u := range o.Users {
+			if u.UUID == "" {
+				u.UUID = known[u.Name]
+			}
+			if u.UUID == "" {
+				u.UUID = spec.NewUUID()
+			}
+			u.Disabled = disabled[u.UUID]
+			users = append(users, u)
+			listed[u.UUID] = struct{}{}
+		}
+		for _, u := range usersToSpec(activeUsers(previous, now)) {
+			if _, ok := listed[u.UUID]; u.ExpiresAt != nil && !ok {
+				users = append(users, u)
+			}
+		}
+		s.Users = users
+	}
+	if len(s.Users) > 0 {
+		s.UUID = primaryUUID(*s)
+	}
+}
+
+// primaryUUID returns the credential the share link of s advertises: the
+// first enabled account outside a rotation grace period. When every user is
+// disabled it falls back to the first one, so the link stays the same until
+// that user is re-enabled.
+func primaryUUID(s spec.InboundSpec) string {
+	for _, u := range s.EnabledAccounts() {
+		if u.ExpiresAt == nil {
+			return u.UUID
+		}
+	}
+	return s.Accounts()[0].UUID
+}
+
+// specFromState rebuilds the spec of an inbound recorded in state.
+func specFromState(domain string, inbound state.Inbound) spec.InboundSpec {
+	return spec.InboundSpec{
+		Key:        inbound.Key,
+		Tag:        inbound.Tag,
+		Name:       inbound.Name,
+		FileName:   inbound.Tag + ".json",
+		Protocol:   inbound.Protocol,
+		Listen:     "127.0.0.1",
+		ListenPort: inbound.ListenPort,
+		UUID:       inbound.UUID,
+		Path:       inbound.Path,
+		Host:       inbound.Host,
+		Transport:  inbound.Transport,
+
+		MaxEarlyData:        inbound.MaxEarlyData,
+		EarlyDataHeaderName: inbound.EarlyDataHeaderName,
+		Users:               usersToSpec(inbound.Users),
+	}
+}
+
+// inboundState records a rendered spec and its share link in state.
+func inboundState(s spec.InboundSpec, link string) state.Inbound {
+	users := make([]state.User, 0, len(s.Users))
+	for _, u := range s.Users {
+		users = append(users, state.User{
+			Name:       u.Name,
+			UUID:       u.UUID,
+			ExpiresAt:  u.ExpiresAt,
+			Quota:      u.Quota,
+			ValidUntil: u.ValidUntil,
+			Disabled:   u.Disabled,
+		})
+	}
+	return state.Inbound{
+		Key:        s.Key,
+		Tag:        s.Tag,
+		Name:       s.Name,
+		Protocol:   s.Protocol,
+		Transport:  s.Transport,
+		ListenPort: s.ListenPort,
+		UUID:       s.UUID,
+		Path:       s.Path,
+		Host:       s.Host,
+		ShareURL:   link,
+
+		MaxEarlyData:        s.MaxEarlyData,
+		EarlyDataHeaderName: s.EarlyDataHeaderName,
+		Users:               users,
+	}
+}
+
+func usersToSpec(users []state.User) []spec.User {
+	if len(users) == 0 {
+		return nil
+	}
+	out := make([]spec.User, 0, len(users))
+	for _, u := range users {
+		out = append(out, spec.User{
+			Name:       u.Name,
+			UUID:       u.UUID,
+			ExpiresAt:  u.ExpiresAt,
+			Quota:      u.Quota,
+			ValidUntil: u.ValidUntil,
+			Disabled:   u.Disabled,
+		})
+	}
+	return out
+}
+
+// activeUsers drops credentials whose grace period ended before now.
+func activeUsers(users []state.User, now time.Time) []state.User {
+	var active []state.User
+	for _, u := range users {
+		if u.ExpiresAt == nil || u.ExpiresAt.After(now) {
+			active = append(active, u)
+		}
+	}
+	return active
+}
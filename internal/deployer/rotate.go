@@ -0,0 +1,205 @@
+package deployer
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"github.com/rogeecn/sing-box-deploy/internal/spec"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+)
+
+// Rotation selects the credentials regenerated by Rotate.
+type Rotation struct {
+	// Keys limits the rotation to these inbounds; empty rotates every
+	// inbound of the domain.
+	Keys []string
+	UUID bool
+	Path bool
+	Port bool
+	// Grace keeps each replaced UUID as an extra user for this long so
+	// clients can pick up the new subscription. Zero drops it immediately.
+	Grace time.Duration
+}
+
+func (r *Rotation) covers(key string) bool {
+	if r == nil {
+		return false
+	}
+	if len(r.Keys) == 0 {
+		return true
+	}
+	for _, k := range r.Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// apply regenerates the UUIDs and path of s. Credentials already in a grace
+// period keep their expiry.
+func (r *Rotation) apply(s *spec.InboundSpec, now time.Time) {
+	if r.UUID {
+		var users, retired []spec.User
+		for _, u := range s.Accounts() {
+			if u.ExpiresAt != nil {
+				retired = append(retired, u)
+				continue
+			}
+			if r.Grace > 0 {
+				expires := now.Add(r.Grace)
+				retired = append(retired, spec.User{Name: u.Name, UUID: u.UUID, ExpiresAt: &expires, Disabled: u.Disabled})
+			}
+			u.UUID = spec.NewUUID()
+			users = append(users, u)
+		}
+		s.Users = append(users, retired...)
+		s.UUID = primaryUUID(*s)
+	}
+	if r.Path {
+		s.Path = "/" + spec.NewUUID()
+	}
+}
+
+// RotationFromPolicy returns the rotation a policy asks for.
+func RotationFromPolicy(p state.RotationPolicy) Rotation {
+	return Rotation{
+		Keys:  p.Keys,
+		UUID:  p.UUID,
+		Path:  p.Path,
+		Port:  p.Port,
+		Grace: time.Duration(p.Grace),
+	}
+}
+
+// SetRotationPolicy records policy for opts.Domain, or clears it when policy
+// is nil. Only the domain, state and lock options of opts are used.
+func SetRotationPolicy(opts Options, policy *state.RotationPolicy) error {
+	if opts.Domain == "" {
+		return fmt.Errorf("domain is required")
+	}
+	if policy != nil && policy.Interval <= 0 {
+		return fmt.Errorf("rotation interval must be positive")
+	}
+	lock, err := state.Acquire(opts.StateFile, opts.WaitLock)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	st, err := state.Load(opts.StateFile)
+	if err != nil {
+		return err
+	}
+	deps, err := st.Select(opts.Domain)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		if err := checkDeployed(deps[0], policy.Keys); err != nil {
+			return err
+		}
+	}
+	deps[0].Rotation = policy
+	return state.Save(opts.StateFile, st)
+}
+
+// Rotate regenerates credentials of inbounds deployed for opts.Domain and
+// re-renders the domain with everything else unchanged. Only the domain,
+// state, binary, port range and validation options of opts are used; the
+// rest comes from the recorded deployment.
+func Rotate(opts Options, rot Rotation) (*state.Deployment, error) {
+	if opts.Domain == "" {
+		return nil, fmt.Errorf("domain is required")
+	}
+	if opts.StateFile == "" {
+		return nil, fmt.Errorf("state file path is required")
+	}
+	if !rot.UUID && !rot.Path && !rot.Port {
+		return nil, fmt.Errorf("nothing to rotate")
+	}
+	keys, err := spec.NormalizeKeys(rot.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(rot.Keys) == 0 {
+		keys = nil
+	}
+	rot.Keys = keys
+
+	lock, err := state.Acquire(opts.StateFile, opts.WaitLock)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	st, err := state.Load(opts.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := st.Select(opts.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDeployed(deps[0], rot.Keys); err != nil {
+		return nil, err
+	}
+	opts = optionsFromDeployment(opts, deps[0])
+	opts.rotation = &rot
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return deploy(opts, st)
+}
+
+// optionsFromDeployment fills opts with the settings dep was deployed with
+// so that re-rendering it changes nothing but what the caller overrides.
+func optionsFromDeployment(opts Options, dep *state.Deployment) Options {
+	opts.Email = dep.Email
+	opts.ProfileName = dep.ProfileName
+	opts.RootDir = dep.RootDir
+	opts.CaddyFile = dep.CaddyFile
+	opts.TLSMode = dep.TLSMode
+	opts.Proxy = dep.Proxy
+	opts.KeepExisting = true
+	opts.Common = nil
+	opts.Routing = nil
+	opts.DNS = nil
+	opts.Stats = nil
+	opts.Log = nil
+	opts.PinnedPorts = nil
+	opts.SubscriptionDir = filepath.Dir(dep.SubscriptionFile)
+	opts.SubscriptionFormats = nil
+	for _, format := range share.Formats {
+		if path, ok := dep.SubscriptionFiles[format]; ok {
+			opts.SubscriptionFormats = append(opts.SubscriptionFormats, format)
+			opts.SubscriptionDir = filepath.Dir(path)
+		}
+	}
+	opts.InboundKeys = nil
+	opts.Overrides = map[string]InboundOverride{}
+	for _, inbound := range dep.Inbounds {
+		opts.InboundKeys = append(opts.InboundKeys, inbound.Key)
+		size := inbound.MaxEarlyData
+		opts.Overrides[inbound.Key] = InboundOverride{
+			MaxEarlyData:        &size,
+			EarlyDataHeaderName: inbound.EarlyDataHeaderName,
+		}
+	}
+	return opts
+}
+
+func checkDeployed(dep *state.Deployment, keys []string) error {
+	for _, key := range keys {
+		found := false
+		for _, inbound := range dep.Inbounds {
+			found = found || inbound.Key == key
+		}
+		if !found {
+			return fmt.Errorf("inbound %s is not deployed for %s", key, dep.Domain)
+		}
+	}
+	return nil
+}
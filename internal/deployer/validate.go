@@ -0,0 +1,120 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
+)
+
+// ValidationError reports a staged configuration rejected by a validator.
+type ValidationError struct {
+	// Tool is the validator command, e.g. "sing-box check".
+	Tool   string
+	Output string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s failed: %v\n%s", e.Tool, e.Err, e.Output)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// validateStaged mirrors the sing-box configuration that tx would produce in
+// root into a staging directory, together with those of caddyFiles that tx
+// rewrites, and runs `sing-box check` and `caddy validate` against them.
+// Nothing is promoted when any validator fails.
+func validateStaged(opts Options, root string, tx *txn.Tx, caddyFiles ...string) error {
+	if opts.SkipValidate {
+		return nil
+	}
+	staging, err := opts.FS.MkdirTemp("", "sing-box-deploy-staging-*")
+	if err != nil {
+		return fmt.Errorf("create staging dir: %w", err)
+	}
+	defer opts.FS.RemoveAll(staging)
+
+	configDir := filepath.Join(staging, "sing-box")
+	if err := opts.FS.MkdirAll(configDir, 0o750); err != nil {
+		return err
+	}
+	if err := stageSingBoxConfig(opts.FS, configDir, root, tx); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if res, err := opts.Runner.Run(ctx, opts.SingBoxBinary, "check", "-C", configDir); err != nil {
+		return &ValidationError{Tool: "sing-box check", Output: res.Output(), Err: err}
+	}
+	for i, caddyFile := range caddyFiles {
+		source, ok := stagedPath(tx, caddyFile)
+		if !ok {
+			continue
+		}
+		stagedCaddy := filepath.Join(staging, fmt.Sprintf("Caddyfile.%d", i))
+		if err := copyFile(opts.FS, source, stagedCaddy); err != nil {
+			return fmt.Errorf("stage %s: %w", caddyFile, err)
+		}
+		if res, err := opts.Runner.Run(ctx, opts.CaddyBinary, "validate", "--adapter", "caddyfile", "--config", stagedCaddy); err != nil {
+			return &ValidationError{Tool: "caddy validate", Output: res.Output(), Err: err}
+		}
+	}
+	return nil
+}
+
+// stageSingBoxConfig copies the *.json files sing-box would load from root
+// after tx commits: the current files minus scheduled removals, overlaid with
+// staged writes.
+func stageSingBoxConfig(fs fsys.FS, dir, root string, tx *txn.Tx) error {
+	sources := map[string]string{}
+	entries, err := fs.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		sources[entry.Name()] = filepath.Join(root, entry.Name())
+	}
+	for _, path := range tx.Removals() {
+		if filepath.Dir(path) == filepath.Clean(root) {
+			delete(sources, filepath.Base(path))
+		}
+	}
+	for _, entry := range tx.Staged() {
+		if filepath.Dir(entry.Target) == filepath.Clean(root) && strings.HasSuffix(entry.Target, ".json") {
+			sources[filepath.Base(entry.Target)] = entry.Temp
+		}
+	}
+	for name, src := range sources {
+		if err := copyFile(fs, src, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("stage %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// stagedPath returns the temp file holding the pending content of target and
+// whether target is part of tx at all.
+func stagedPath(tx *txn.Tx, target string) (string, bool) {
+	for _, entry := range tx.Staged() {
+		if entry.Target == target {
+			return entry.Temp, true
+		}
+	}
+	return "", false
+}
+
+func copyFile(fs fsys.FS, src, dst string) error {
+	data, err := fs.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(dst, data, 0o640)
+}
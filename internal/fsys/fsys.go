@@ -0,0 +1,77 @@
+// Package fsys abstracts the filesystem a deployment is written to, so the
+// same rendering code can target this machine or a remote server.
+package fsys
+
+import (
+	"io"
+	"os"
+)
+
+// FS is the set of file operations deployments need.
+type FS interface {
+	ReadFile(name string) ([]byte, error)
+	// WriteFile creates or truncates name; it is not atomic.
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(name string, perm os.FileMode) error
+	// MkdirTemp creates a new directory like os.MkdirTemp; an empty dir
+	// means the temporary directory of the target.
+	MkdirTemp(dir, pattern string) (string, error)
+	// CreateTemp creates a new file like os.CreateTemp.
+	CreateTemp(dir, pattern string) (File, error)
+	// Rename replaces newpath atomically.
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Chown(name string, uid, gid int) error
+	// SyncDir flushes the entries of directory name after renames, where
+	// the target supports it.
+	SyncDir(name string)
+}
+
+// File is a file created by CreateTemp.
+type File interface {
+	io.Writer
+	Name() string
+	Chmod(mode os.FileMode) error
+	// Sync flushes the content to stable storage.
+	Sync() error
+	Close() error
+}
+
+// Local is the filesystem of this machine.
+type Local struct{}
+
+func (Local) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+
+func (Local) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (Local) ReadDir(name string) ([]os.DirEntry, error) { return os.ReadDir(name) }
+
+func (Local) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (Local) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+
+func (Local) MkdirTemp(dir, pattern string) (string, error) { return os.MkdirTemp(dir, pattern) }
+
+func (Local) CreateTemp(dir, pattern string) (File, error) { return os.CreateTemp(dir, pattern) }
+
+func (Local) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (Local) Remove(name string) error { return os.Remove(name) }
+
+func (Local) RemoveAll(name string) error { return os.RemoveAll(name) }
+
+func (Local) Chown(name string, uid, gid int) error { return os.Chown(name, uid, gid) }
+
+func (Local) SyncDir(name string) {
+	d, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
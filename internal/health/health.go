@@ -0,0 +1,226 @@
+// Package health probes deployed inbounds: the local sing-box listener and
+// the public Caddy route in front of it.
+package health
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+)
+
+// Check is the outcome of a single probe.
+type Check struct {
+	OK        bool          `json:"ok" yaml:"ok"`
+	Latency   time.Duration `json:"-" yaml:"-"`
+	LatencyMS float64       `json:"latency_ms" yaml:"latency_ms"`
+	Error     string        `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Result groups the probes run for one inbound.
+type Result struct {
+	Domain    string `json:"domain" yaml:"domain"`
+	Tag       string `json:"tag" yaml:"tag"`
+	Key       string `json:"key" yaml:"key"`
+	Transport string `json:"transport" yaml:"transport"`
+	Local     Check  `json:"local" yaml:"local"`
+	Route     Check  `json:"route" yaml:"route"`
+	// CertExpires is the NotAfter of the certificate the public route
+	// presented, if the TLS handshake got that far.
+	CertExpires *time.Time `json:"cert_expires,omitempty" yaml:"cert_expires,omitempty"`
+}
+
+// OK reports whether every probe succeeded.
+func (r Result) OK() bool {
+	return r.Local.OK && r.Route.OK
+}
+
+// Prober runs the health checks.
+type Prober struct {
+	// Timeout bounds each probe; defaults to 5s.
+	Timeout time.Duration
+	// Address overrides where the public route is dialed (host:port);
+	// defaults to <domain>:443.
+	Address string
+	// Insecure skips certificate verification on the public route.
+	Insecure bool
+	// Dial connects to the local listeners; defaults to dialing on this
+	// machine. Probing another host passes its SSH client.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (p *Prober) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return p.Timeout
+}
+
+// Probe checks the local listener and the public route of inbound.
+func (p *Prober) Probe(ctx context.Context, domain string, inbound state.Inbound) Result {
+	res := Result{
+		Domain:    domain,
+		Tag:       inbound.Tag,
+		Key:       inbound.Key,
+		Transport: inbound.Transport,
+	}
+	res.Local = p.measure(ctx, func(ctx context.Context) error {
+		dial := p.Dial
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		conn, err := dial(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(inbound.ListenPort)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	res.Route = p.measure(ctx, func(ctx context.Context) error {
+		conn, expires, err := p.dialRoute(ctx, domain, inbound)
+		res.CertExpires = expires
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return probeRoute(conn, domain, inbound)
+	})
+	return res
+}
+
+func (p *Prober) measure(ctx context.Context, fn func(context.Context) error) Check {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+	start := time.Now()
+	err := fn(ctx)
+	elapsed := time.Since(start)
+	check := Check{
+		OK:        err == nil,
+		Latency:   elapsed,
+		LatencyMS: float64(elapsed.Microseconds()) / 1000,
+	}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// dialRoute completes the TLS handshake with the public route. It returns
+// the certificate expiry even when verification fails, so an expired
+// certificate is still reported.
+func (p *Prober) dialRoute(ctx context.Context, domain string, inbound state.Inbound) (*tls.Conn, *time.Time, error) {
+	addr := p.Address
+	if addr == "" {
+		addr = net.JoinHostPort(domain, "443")
+	}
+	alpn := "http/1.1"
+	if inbound.Transport == "http" {
+		alpn = "h2"
+	}
+	var expires *time.Time
+	dialer := &tls.Dialer{Config: &tls.Config{
+		ServerName: domain,
+		NextProtos: []string{alpn},
+		// Verification happens in VerifyConnection, after the leaf
+		// certificate has been recorded.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no certificate presented")
+			}
+			leaf := cs.PeerCertificates[0]
+			notAfter := leaf.NotAfter
+			expires = &notAfter
+			if p.Insecure {
+				return nil
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := leaf.Verify(x509.VerifyOptions{DNSName: cs.ServerName, Intermediates: intermediates})
+			return err
+		},
+	}}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, expires, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn.(*tls.Conn), expires, nil
+}
+
+// probeRoute checks that the route forwards the inbound's transport.
+func probeRoute(conn *tls.Conn, domain string, inbound state.Inbound) error {
+	switch inbound.Transport {
+	case "ws", "httpupgrade":
+		return probeUpgrade(conn, domain, inbound)
+	case "http":
+		return probeH2(conn)
+	default:
+		return fmt.Errorf("no route probe for transport %s", inbound.Transport)
+	}
+}
+
+// probeUpgrade sends a WebSocket handshake on the inbound path; both the ws
+// and httpupgrade transports answer it with 101 Switching Protocols.
+func probeUpgrade(conn net.Conn, domain string, inbound state.Inbound) error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	host := inbound.Host
+	if host == "" {
+		host = domain
+	}
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		inbound.Path, host, base64.StdEncoding.EncodeToString(nonce[:]))
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// probeH2 verifies the route speaks HTTP/2 by exchanging connection
+// prefaces: the server must answer with a SETTINGS frame.
+func probeH2(conn *tls.Conn) error {
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		return fmt.Errorf("server negotiated %q instead of h2", proto)
+	}
+	preface := []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	emptySettings := []byte{0, 0, 0, 0x4, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(append(preface, emptySettings...)); err != nil {
+		return err
+	}
+	var header [9]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[3] != 0x4 {
+		return fmt.Errorf("expected SETTINGS frame, got type %d", header[3])
+	}
+	length := binary.BigEndian.Uint32(append([]byte{0}, header[0:3]...))
+	_, err := io.CopyN(io.Discard, conn, int64(length))
+	return err
+}
@@ -0,0 +1,197 @@
+// Package inventory lists the hosts of a fleet that deploy the same profile,
+// as consumed by the fleet commands.
+package inventory
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/manifest"
+	"github.com/rogeecn/sing-box-deploy/internal/remote"
+	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultName = "fleet"
+
+// Inventory is the fleet document.
+type Inventory struct {
+	// Name titles the merged subscription and names its files; defaults to
+	// "fleet".
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// SubscriptionDir receives the merged subscription; defaults to
+	// "subscriptions" next to the inventory file.
+	SubscriptionDir string  `json:"subscription_dir,omitempty" yaml:"subscription_dir,omitempty"`
+	Profile         Profile `json:"profile" yaml:"profile"`
+	Hosts           []Host  `json:"hosts" yaml:"hosts"`
+}
+
+// Profile is the manifest every host deploys without its domains: the
+// inbounds are served on the domain of each host.
+type Profile struct {
+	manifest.Manifest `yaml:",inline"`
+	Inbounds          []manifest.Inbound `json:"inbounds,omitempty" yaml:"inbounds,omitempty"`
+}
+
+// Host is one node of the fleet. Empty fields fall back to the profile.
+type Host struct {
+	// Host is the SSH target, [user@]host[:port].
+	Host   string `json:"host" yaml:"host"`
+	Domain string `json:"domain" yaml:"domain"`
+	// Name names the node in the merged subscription; defaults to the host
+	// name of the target.
+	Name  string `json:"name,omitempty" yaml:"name,omitempty"`
+	Email string `json:"email,omitempty" yaml:"email,omitempty"`
+	Proxy string `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	TLS   string `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// Inbounds replaces the inbounds of the profile.
+	Inbounds []manifest.Inbound `json:"inbounds,omitempty" yaml:"inbounds,omitempty"`
+	// Root and Caddy are the sing-box directory and the Caddyfile on the
+	// host; default /etc/sing-box and /etc/caddy/Caddyfile.
+	Root  string `json:"root,omitempty" yaml:"root,omitempty"`
+	Caddy string `json:"caddy,omitempty" yaml:"caddy,omitempty"`
+	// State is the local state file of the host; empty means the per-host
+	// default of --host.
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+// Load reads a YAML or JSON inventory and validates it. Relative paths are
+// resolved against the directory of the file.
+func Load(path string) (*Inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read inventory: %w", err)
+	}
+	var inv Inventory
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&inv); err != nil {
+		return nil, fmt.Errorf("parse inventory %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	if inv.SubscriptionDir == "" {
+		inv.SubscriptionDir = "subscriptions"
+	}
+	inv.SubscriptionDir = resolve(dir, inv.SubscriptionDir)
+	for i := range inv.Hosts {
+		if inv.Hosts[i].State != "" {
+			inv.Hosts[i].State = resolve(dir, inv.Hosts[i].State)
+		}
+	}
+	if err := inv.Validate(); err != nil {
+		return nil, fmt.Errorf("inventory %s: %w", path, err)
+	}
+	return &inv, nil
+}
+
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Validate fills in defaults and checks every host's manifest.
+func (inv *Inventory) Validate() error {
+	if inv.Name == "" {
+		inv.Name = defaultName
+	}
+	if len(inv.Profile.Domains) > 0 {
+		return fmt.Errorf("profile: domains are set per host")
+	}
+	if len(inv.Hosts) == 0 {
+		return fmt.Errorf("no hosts defined")
+	}
+	targets := map[string]struct{}{}
+	domains := map[string]struct{}{}
+	names := map[string]struct{}{}
+	for i := range inv.Hosts {
+		h := &inv.Hosts[i]
+		if h.Host == "" {
+			return fmt.Errorf("hosts[%d]: host is required", i)
+		}
+		target, err := remote.CanonicalName(h.Host)
+		if err != nil {
+			return fmt.Errorf("hosts[%d]: %w", i, err)
+		}
+		if _, ok := targets[target]; ok {
+			return fmt.Errorf("host %s is listed twice", target)
+		}
+		targets[target] = struct{}{}
+		h.Domain = strings.ToLower(strings.TrimSpace(h.Domain))
+		if h.Domain == "" {
+			return fmt.Errorf("%s: domain is required", h.Host)
+		}
+		if _, ok := domains[h.Domain]; ok {
+			return fmt.Errorf("domain %s is listed twice", h.Domain)
+		}
+		domains[h.Domain] = struct{}{}
+		if h.Name == "" {
+			_, host, _, _ := remote.ParseTarget(h.Host)
+			h.Name = host
+		}
+		if _, ok := names[h.Name]; ok {
+			return fmt.Errorf("node name %s is used twice", h.Name)
+		}
+		names[h.Name] = struct{}{}
+		if h.Root != "" && !filepath.IsAbs(h.Root) || h.Caddy != "" && !filepath.IsAbs(h.Caddy) {
+			return fmt.Errorf("%s: root and caddy must be absolute paths", h.Host)
+		}
+		if err := inv.Manifest(*h).Validate(); err != nil {
+			return fmt.Errorf("%s: %w", h.Host, err)
+		}
+	}
+	return nil
+}
+
+// Manifest returns what h deploys: the profile on the domain of h.
+func (inv *Inventory) Manifest(h Host) *manifest.Manifest {
+	m := inv.Profile.Manifest
+	inbounds := h.Inbounds
+	if len(inbounds) == 0 {
+		inbounds = inv.Profile.Inbounds
+	}
+	m.Domains = []manifest.Site{{
+		Domain:   h.Domain,
+		Name:     h.Name,
+		Email:    h.Email,
+		Proxy:    h.Proxy,
+		TLS:      h.TLS,
+		Inbounds: inbounds,
+	}}
+	return &m
+}
+
+// Select returns the hosts with the given node names, or every host when
+// none are given.
+func (inv *Inventory) Select(names []string) ([]Host, error) {
+	if len(names) == 0 {
+		return inv.Hosts, nil
+	}
+	var hosts []Host
+	for _, name := range names {
+		found := false
+		for _, h := range inv.Hosts {
+			if h.Name == name {
+				hosts = append(hosts, h)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no node named %q in the inventory", name)
+		}
+	}
+	return hosts, nil
+}
+
+// Formats returns the subscription formats of the profile.
+func (inv *Inventory) Formats() []string {
+	if len(inv.Profile.Subscriptions) == 0 {
+		return []string{share.FormatText}
+	}
+	return inv.Profile.Subscriptions
+}
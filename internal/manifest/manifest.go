@@ -0,0 +1,361 @@
+// Package manifest describes a host's desired deployments declaratively, as
+// consumed by `deploy -f` and produced by `export manifest`.
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/deployer"
+	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+	"github.com/rogeecn/sing-box-deploy/internal/spec"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"gopkg.in/yaml.v3"
+)
+
+// User names and UUIDs are rendered into the inbound JSON and the stats
+// counter names unescaped.
+var (
+	userNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	uuidPattern     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// Manifest is the top-level deployment document. Host-wide fields act as
+// defaults for every site.
+type Manifest struct {
+	Email         string             `json:"email,omitempty" yaml:"email,omitempty"`
+	Proxy         string             `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	TLS           string             `json:"tls,omitempty" yaml:"tls,omitempty"`
+	Subscriptions []string           `json:"subscriptions,omitempty" yaml:"subscriptions,omitempty"`
+	Log           singbox.Log        `json:"log,omitempty" yaml:"log,omitempty"`
+	Routing       singbox.Routing    `json:"routing,omitempty" yaml:"routing,omitempty"`
+	DNS           singbox.DNS        `json:"dns,omitempty" yaml:"dns,omitempty"`
+	Outbounds     []singbox.Outbound `json:"outbounds,omitempty" yaml:"outbounds,omitempty"`
+	Stats         singbox.Stats      `json:"stats,omitempty" yaml:"stats,omitempty"`
+	Domains       []Site             `json:"domains" yaml:"domains"`
+}
+
+// Site is one domain and the inbounds served on it.
+type Site struct {
+	Domain   string    `json:"domain" yaml:"domain"`
+	Email    string    `json:"email,omitempty" yaml:"email,omitempty"`
+	Name     string    `json:"name,omitempty" yaml:"name,omitempty"`
+	Proxy    string    `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	TLS      string    `json:"tls,omitempty" yaml:"tls,omitempty"`
+	Inbounds []Inbound `json:"inbounds" yaml:"inbounds"`
+}
+
+// Inbound selects an inbound template and optionally overrides its values.
+type Inbound struct {
+	Type string `json:"type" yaml:"type"`
+	Port int    `json:"port,omitempty" yaml:"port,omitempty"`
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+	// UUID pins the credential of an inbound without users.
+	UUID      string     `json:"uuid,omitempty" yaml:"uuid,omitempty"`
+	Users     []User     `json:"users,omitempty" yaml:"users,omitempty"`
+	Transport *Transport `json:"transport,omitempty" yaml:"transport,omitempty"`
+}
+
+// User is an inbound account; a missing UUID is generated on first deploy
+// and kept afterwards. Quota and ValidUntil are applied by `enforce`.
+type User struct {
+	Name string `json:"name" yaml:"name"`
+	UUID string `json:"uuid,omitempty" yaml:"uuid,omitempty"`
+	// Quota is the monthly traffic allowance, e.g. "100GiB".
+	Quota      Size  `json:"quota,omitempty" yaml:"quota,omitempty"`
+	ValidUntil *Date `json:"valid_until,omitempty" yaml:"valid_until,omitempty"`
+}
+
+// Transport holds transport specific options.
+type Transport struct {
+	MaxEarlyData        *int   `json:"max_early_data,omitempty" yaml:"max_early_data,omitempty"`
+	EarlyDataHeaderName string `json:"early_data_header_name,omitempty" yaml:"early_data_header_name,omitempty"`
+}
+
+// Load reads a YAML or JSON manifest and validates it.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	var m Manifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Validate normalises names and checks the manifest for consistency.
+func (m *Manifest) Validate() error {
+	if len(m.Domains) == 0 {
+		return fmt.Errorf("no domains defined")
+	}
+	for _, format := range m.Subscriptions {
+		if !share.ValidFormat(format) {
+			return fmt.Errorf("unknown subscription format %q", format)
+		}
+	}
+	if err := m.common().Validate(); err != nil {
+		return err
+	}
+	domains := map[string]struct{}{}
+	for i := range m.Domains {
+		site := &m.Domains[i]
+		site.Domain = strings.ToLower(strings.TrimSpace(site.Domain))
+		if site.Domain == "" {
+			return fmt.Errorf("domains[%d]: domain is required", i)
+		}
+		if _, ok := domains[site.Domain]; ok {
+			return fmt.Errorf("domain %s is listed twice", site.Domain)
+		}
+		domains[site.Domain] = struct{}{}
+		if len(site.Inbounds) == 0 {
+			return fmt.Errorf("%s: no inbounds defined", site.Domain)
+		}
+		types := map[string]struct{}{}
+		for j := range site.Inbounds {
+			inbound := &site.Inbounds[j]
+			inbound.Type = strings.ToLower(strings.TrimSpace(inbound.Type))
+			if !spec.Exists(inbound.Type) {
+				return fmt.Errorf("%s: unknown inbound type %q", site.Domain, inbound.Type)
+			}
+			if _, ok := types[inbound.Type]; ok {
+				return fmt.Errorf("%s: inbound %s is listed twice", site.Domain, inbound.Type)
+			}
+			types[inbound.Type] = struct{}{}
+			if inbound.Path != "" && !strings.HasPrefix(inbound.Path, "/") {
+				return fmt.Errorf("%s/%s: path must start with /", site.Domain, inbound.Type)
+			}
+			if inbound.UUID != "" && len(inbound.Users) > 0 {
+				return fmt.Errorf("%s/%s: uuid and users cannot be combined, give the uuid to a user", site.Domain, inbound.Type)
+			}
+			if inbound.UUID != "" && !uuidPattern.MatchString(inbound.UUID) {
+				return fmt.Errorf("%s/%s: invalid uuid %q", site.Domain, inbound.Type, inbound.UUID)
+			}
+			names := map[string]struct{}{}
+			for _, u := range inbound.Users {
+				if u.Name == "" {
+					return fmt.Errorf("%s/%s: user name is required", site.Domain, inbound.Type)
+				}
+				if !userNamePattern.MatchString(u.Name) {
+					return fmt.Errorf("%s/%s: user name %q may only contain letters, digits, '.', '_' and '-'", site.Domain, inbound.Type, u.Name)
+				}
+				if u.UUID != "" && !uuidPattern.MatchString(u.UUID) {
+					return fmt.Errorf("%s/%s: user %s: invalid uuid %q", site.Domain, inbound.Type, u.Name, u.UUID)
+				}
+				if _, ok := names[u.Name]; ok {
+					return fmt.Errorf("%s/%s: user %s is listed twice", site.Domain, inbound.Type, u.Name)
+				}
+				names[u.Name] = struct{}{}
+			}
+		}
+	}
+	return nil
+}
+
+// Options converts site into deployer options layered over base, which
+// carries host paths, binaries and other flags. Existing inbounds keep their
+// generated values so repeated runs converge instead of rotating secrets.
+func (m *Manifest) Options(site Site, base deployer.Options) deployer.Options {
+	opts := base
+	opts.Domain = site.Domain
+	opts.Email = firstNonEmpty(site.Email, m.Email, "info@"+site.Domain)
+	opts.ProfileName = site.Name
+	opts.TLSMode = firstNonEmpty(site.TLS, m.TLS)
+	opts.Proxy = firstNonEmpty(site.Proxy, m.Proxy)
+	opts.SubscriptionFormats = m.Subscriptions
+	opts.KeepExisting = true
+	common := m.common()
+	opts.Common = &common
+	opts.InboundKeys = nil
+	opts.PinnedPorts = map[string]int{}
+	opts.Overrides = map[string]deployer.InboundOverride{}
+	for _, inbound := range site.Inbounds {
+		opts.InboundKeys = append(opts.InboundKeys, inbound.Type)
+		if inbound.Port != 0 {
+			opts.PinnedPorts[inbound.Type] = inbound.Port
+		}
+		override := deployer.InboundOverride{
+			Path: inbound.Path,
+			Host: inbound.Host,
+			UUID: inbound.UUID,
+		}
+		for _, u := range inbound.Users {
+			user := spec.User{Name: u.Name, UUID: u.UUID, Quota: int64(u.Quota)}
+			if u.ValidUntil != nil {
+				validUntil := u.ValidUntil.Time
+				user.ValidUntil = &validUntil
+			}
+			override.Users = append(override.Users, user)
+		}
+		if inbound.Transport != nil {
+			override.MaxEarlyData = inbound.Transport.MaxEarlyData
+			override.EarlyDataHeaderName = inbound.Transport.EarlyDataHeaderName
+		}
+		opts.Overrides[inbound.Type] = override
+	}
+	return opts
+}
+
+// Converge deploys every site over base and removes the domains of the
+// state file the manifest does not list. progress, if set, is called after
+// each domain is deployed or removed. Every domain is committed on its own,
+// so on error the domains already deployed and removed are returned too.
+func (m *Manifest) Converge(base deployer.Options, progress func(dep *state.Deployment, removed bool)) (deployed []*state.Deployment, removed []string, err error) {
+	if progress == nil {
+		progress = func(*state.Deployment, bool) {}
+	}
+	for _, site := range m.Domains {
+		dep, err := deployer.Run(m.Options(site, base))
+		if err != nil {
+			return deployed, removed, fmt.Errorf("%s: %w", site.Domain, err)
+		}
+		deployed = append(deployed, dep)
+		progress(dep, false)
+	}
+	st, err := state.Load(base.StateFile)
+	if err != nil {
+		return deployed, removed, err
+	}
+	for _, domain := range st.Domains() {
+		if m.Has(domain) {
+			continue
+		}
+		opts := base
+		opts.Domain = domain
+		dep, err := deployer.Remove(opts)
+		if err != nil {
+			return deployed, removed, fmt.Errorf("%s: %w", domain, err)
+		}
+		removed = append(removed, dep.Domain)
+		progress(dep, true)
+	}
+	return deployed, removed, nil
+}
+
+// common returns the host-wide sing-box settings of the manifest.
+func (m *Manifest) common() singbox.Common {
+	return singbox.Common{Log: m.Log, Routing: m.Routing, DNS: m.DNS, Outbounds: m.Outbounds, Stats: m.Stats}
+}
+
+// Has reports whether the manifest lists domain.
+func (m *Manifest) Has(domain string) bool {
+	for _, site := range m.Domains {
+		if site.Domain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// FromState describes the current deployments as a manifest, pinning every
+// generated value so that deploying it reproduces the host.
+func FromState(st *state.State) *Manifest {
+	m := &Manifest{
+		Log:       st.Common.Log,
+		Routing:   st.Common.Routing,
+		DNS:       st.Common.DNS,
+		Outbounds: st.Common.Outbounds,
+		Stats:     st.Common.Stats,
+	}
+	formats := map[string]struct{}{}
+	for _, domain := range st.Domains() {
+		dep := st.Deployments[domain]
+		site := Site{
+			Domain: dep.Domain,
+			Email:  dep.Email,
+			Name:   dep.ProfileName,
+			Proxy:  dep.Proxy,
+			TLS:    dep.TLSMode,
+		}
+		inbounds := append([]state.Inbound(nil), dep.Inbounds...)
+		sort.Slice(inbounds, func(i, j int) bool { return inbounds[i].Key < inbounds[j].Key })
+		for _, inbound := range inbounds {
+			entry := Inbound{
+				Type: inbound.Key,
+				Port: inbound.ListenPort,
+				Path: inbound.Path,
+			}
+			if inbound.Host != dep.Domain {
+				entry.Host = inbound.Host
+			}
+			for _, u := range inbound.Users {
+				// Credentials in a rotation grace period are carried over
+				// by deploy until they expire.
+				if u.ExpiresAt == nil && u.Name != "" {
+					user := User{Name: u.Name, UUID: u.UUID, Quota: Size(u.Quota)}
+					if u.ValidUntil != nil {
+						user.ValidUntil = &Date{*u.ValidUntil}
+					}
+					entry.Users = append(entry.Users, user)
+				}
+			}
+			if len(entry.Users) == 0 {
+				// A single credential, possibly rotated with a grace
+				// period, is not rendered with a user name.
+				entry.UUID = inbound.UUID
+			}
+			if inbound.Transport == "ws" {
+				size := inbound.MaxEarlyData
+				entry.Transport = &Transport{MaxEarlyData: &size, EarlyDataHeaderName: inbound.EarlyDataHeaderName}
+			}
+			site.Inbounds = append(site.Inbounds, entry)
+		}
+		for format := range dep.SubscriptionFiles {
+			formats[format] = struct{}{}
+		}
+		m.Domains = append(m.Domains, site)
+	}
+	for _, format := range share.Formats {
+		if _, ok := formats[format]; ok {
+			m.Subscriptions = append(m.Subscriptions, format)
+		}
+	}
+	return m
+}
+
+// Marshal encodes the manifest as "yaml" or "json".
+func (m *Manifest) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "yaml", "yml", "":
+		return yaml.Marshal(m)
+	case "json":
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unsupported manifest format %q", format)
+	}
+}
+
+// FormatFromPath guesses the manifest format from a file extension.
+func FormatFromPath(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return "json"
+	}
+	return "yaml"
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
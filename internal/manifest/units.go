@@ -0,0 +1,80 @@
+package manifest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size is a byte count written with an optional unit: KB, MB, GB and TB are
+// powers of 1000, KiB, MiB, GiB and TiB powers of 1024.
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"B", 1},
+}
+
+// MarshalText writes the largest unit that divides the size exactly.
+func (s Size) MarshalText() ([]byte, error) {
+	best := sizeUnits[len(sizeUnits)-1]
+	for _, unit := range sizeUnits {
+		if s != 0 && int64(s)%unit.factor == 0 && unit.factor > best.factor {
+			best = unit
+		}
+	}
+	if best.factor == 1 {
+		return []byte(strconv.FormatInt(int64(s), 10)), nil
+	}
+	return []byte(strconv.FormatInt(int64(s)/best.factor, 10) + best.suffix), nil
+}
+
+// UnmarshalText parses sizes such as "100GiB", "1.5TB" or "1048576".
+func (s *Size) UnmarshalText(text []byte) error {
+	value := strings.TrimSpace(string(text))
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(strings.ToLower(value), strings.ToLower(unit.suffix)) {
+			value = strings.TrimSpace(value[:len(value)-len(unit.suffix)])
+			factor = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", text)
+	}
+	*s = Size(n * float64(factor))
+	return nil
+}
+
+// Date is a point in time written as a date (midnight UTC) or in RFC 3339.
+type Date struct {
+	time.Time
+}
+
+// MarshalText writes midnight UTC as a plain date.
+func (d Date) MarshalText() ([]byte, error) {
+	t := d.UTC()
+	if t.Equal(t.Truncate(24 * time.Hour)) {
+		return []byte(t.Format(time.DateOnly)), nil
+	}
+	return []byte(t.Format(time.RFC3339)), nil
+}
+
+// UnmarshalText parses "2006-01-02" or RFC 3339.
+func (d *Date) UnmarshalText(text []byte) error {
+	value := strings.TrimSpace(string(text))
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			d.Time = t.UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid date %q (want YYYY-MM-DD or RFC 3339)", text)
+}
@@ -0,0 +1,199 @@
+// Package ports allocates listen ports for inbounds without colliding with
+// other inbounds or sockets already bound on the host.
+package ports
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+)
+
+// Range is an inclusive port range.
+type Range struct {
+	Min int
+	Max int
+}
+
+// DefaultRange matches the Linux ephemeral-looking high ports used so far.
+var DefaultRange = Range{Min: 32768, Max: 65535}
+
+// ParseRange parses "min-max".
+func ParseRange(s string) (Range, error) {
+	lo, hi, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return Range{}, fmt.Errorf("invalid port range %q, want min-max", s)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	r := Range{Min: min, Max: max}
+	return r, r.validate()
+}
+
+func (r Range) validate() error {
+	if r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+		return fmt.Errorf("invalid port range %d-%d", r.Min, r.Max)
+	}
+	return nil
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+const maxAttempts = 128
+
+// Allocator hands out ports from Range that are neither excluded, reserved
+// nor currently bound.
+type Allocator struct {
+	rng      Range
+	excluded map[int]struct{}
+	reserved map[int]string
+	bound    map[int]struct{}
+}
+
+// New creates an allocator that avoids the ports in bound, the listening
+// sockets of the host as returned by ListeningPorts.
+func New(rng Range, exclude []int, bound map[int]struct{}) (*Allocator, error) {
+	if rng == (Range{}) {
+		rng = DefaultRange
+	}
+	if err := rng.validate(); err != nil {
+		return nil, err
+	}
+	if bound == nil {
+		bound = map[int]struct{}{}
+	}
+	a := &Allocator{
+		rng:      rng,
+		excluded: map[int]struct{}{},
+		reserved: map[int]string{},
+		bound:    bound,
+	}
+	for _, p := range exclude {
+		a.excluded[p] = struct{}{}
+	}
+	return a, nil
+}
+
+// Reserve marks port as taken by owner, e.g. an inbound tag from state.
+func (a *Allocator) Reserve(port int, owner string) {
+	a.reserved[port] = owner
+}
+
+// Release forgets a previous reservation, so a redeployed inbound can keep
+// its own port.
+func (a *Allocator) Release(port int) {
+	delete(a.reserved, port)
+	delete(a.bound, port)
+}
+
+// Pin reserves a specific port for owner. Pins may lie outside the range but
+// must not be excluded or collide with a reservation or a bound socket.
+func (a *Allocator) Pin(port int, owner string) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d for %s", port, owner)
+	}
+	if _, ok := a.excluded[port]; ok {
+		return fmt.Errorf("port %d for %s is excluded", port, owner)
+	}
+	if other, ok := a.reserved[port]; ok {
+		return fmt.Errorf("port %d for %s is already used by %s", port, owner, other)
+	}
+	if _, ok := a.bound[port]; ok {
+		return fmt.Errorf("port %d for %s is already bound by another process", port, owner)
+	}
+	a.reserved[port] = owner
+	return nil
+}
+
+// Allocate picks a random free port for owner, retrying on conflicts.
+func (a *Allocator) Allocate(owner string) (int, error) {
+	span := int64(a.rng.Max - a.rng.Min + 1)
+	for i := 0; i < maxAttempts; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(span))
+		if err != nil {
+			return 0, fmt.Errorf("random port: %w", err)
+		}
+		port := a.rng.Min + int(n.Int64())
+		if !a.available(port) {
+			continue
+		}
+		a.reserved[port] = owner
+		return port, nil
+	}
+	for port := a.rng.Min; port <= a.rng.Max; port++ {
+		if a.available(port) {
+			a.reserved[port] = owner
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port left in range %s for %s", a.rng, owner)
+}
+
+func (a *Allocator) available(port int) bool {
+	if _, ok := a.excluded[port]; ok {
+		return false
+	}
+	if _, ok := a.reserved[port]; ok {
+		return false
+	}
+	_, ok := a.bound[port]
+	return !ok
+}
+
+// ListeningPorts returns the TCP ports in LISTEN state on the host whose
+// filesystem is target, read from /proc/net/tcp and /proc/net/tcp6. Missing
+// /proc files (non-Linux hosts) yield an empty set.
+func ListeningPorts(target fsys.FS) (map[int]struct{}, error) {
+	ports := map[int]struct{}{}
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := readProcNet(target, file, ports); err != nil {
+			return nil, err
+		}
+	}
+	return ports, nil
+}
+
+// readProcNet parses lines like
+// "0: 0100007F:1F90 00000000:0000 0A ..." where 0A is TCP_LISTEN.
+func readProcNet(target fsys.FS, path string, ports map[int]struct{}) error {
+	data, err := target.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != "0A" {
+			continue
+		}
+		_, hexPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseUint(hexPort, 16, 16)
+		if err != nil {
+			continue
+		}
+		ports[int(port)] = struct{}{}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,157 @@
+// Package prompt asks the operator questions. Every interactive question in
+// the CLI goes through a Prompter so automation can turn prompts off and
+// tests can script the answers.
+package prompt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var (
+	// ErrNonInteractive is returned when a question has no safe default and
+	// prompting is disabled.
+	ErrNonInteractive = errors.New("input required but prompts are disabled")
+	// ErrNoInput is returned when input ends before a required answer.
+	ErrNoInput = errors.New("no answer on input")
+)
+
+// Prompter asks questions.
+type Prompter interface {
+	// Confirm asks a yes/no question; def is used for an empty answer.
+	Confirm(question string, def bool) (bool, error)
+	// Select lists options under title and asks for their numbers, separated
+	// by commas or spaces. An empty answer or "all" selects every option.
+	Select(title, question string, options []string) ([]string, error)
+}
+
+// IsTerminal reports whether r is an interactive terminal.
+func IsTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// Terminal reads answers line by line and writes questions to its output.
+type Terminal struct {
+	out    io.Writer
+	reader *bufio.Reader
+}
+
+// NewTerminal returns a Prompter reading from in and writing to out. in may
+// be any reader, which lets tests script the answers.
+func NewTerminal(in io.Reader, out io.Writer) *Terminal {
+	return &Terminal{out: out, reader: bufio.NewReader(in)}
+}
+
+func (t *Terminal) readLine() (string, error) {
+	line, err := t.reader.ReadString('\n')
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		if line == "" {
+			return "", ErrNoInput
+		}
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Confirm implements Prompter. Input that ends without an answer counts as
+// the default.
+func (t *Terminal) Confirm(question string, def bool) (bool, error) {
+	hint := "[y/N]"
+	if def {
+		hint = "[Y/n]"
+	}
+	fmt.Fprintf(t.out, "%s %s: ", question, hint)
+	line, err := t.readLine()
+	if errors.Is(err, ErrNoInput) {
+		fmt.Fprintln(t.out)
+		return def, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(line) {
+	case "":
+		return def, nil
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// Select implements Prompter.
+func (t *Terminal) Select(title, question string, options []string) ([]string, error) {
+	fmt.Fprintln(t.out, title)
+	for i, option := range options {
+		fmt.Fprintf(t.out, "  %d) %s\n", i+1, option)
+	}
+	fmt.Fprintf(t.out, "%s: ", question)
+	line, err := t.readLine()
+	if err != nil {
+		fmt.Fprintln(t.out)
+		return nil, err
+	}
+	if line == "" || strings.EqualFold(line, "all") {
+		return options, nil
+	}
+
+	separators := []rune{',', '，', ' ', '\t', ';'}
+	tokens := strings.FieldsFunc(line, func(r rune) bool {
+		for _, sep := range separators {
+			if r == sep {
+				return true
+			}
+		}
+		return false
+	})
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("未选择任何选项")
+	}
+	indices := make(map[int]struct{})
+	var selected []string
+	for _, token := range tokens {
+		idx, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, fmt.Errorf("无效编号: %s", token)
+		}
+		if idx < 1 || idx > len(options) {
+			return nil, fmt.Errorf("编号超出范围: %d", idx)
+		}
+		if _, ok := indices[idx]; ok {
+			continue
+		}
+		indices[idx] = struct{}{}
+		selected = append(selected, options[idx-1])
+	}
+	return selected, nil
+}
+
+// Unattended answers without reading input: confirmations take their
+// default, or yes when AssumeYes is set, and selections fail with
+// ErrNonInteractive.
+type Unattended struct {
+	AssumeYes bool
+}
+
+// Confirm implements Prompter.
+func (u Unattended) Confirm(question string, def bool) (bool, error) {
+	return def || u.AssumeYes, nil
+}
+
+// Select implements Prompter.
+func (u Unattended) Select(title, question string, options []string) ([]string, error) {
+	return nil, ErrNonInteractive
+}
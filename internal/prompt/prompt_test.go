@@ -0,0 +1,93 @@
+package prompt
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTerminalConfirm(t *testing.T) {
+	tests := []struct {
+		input string
+		def   bool
+		want  bool
+	}{
+		{input: "y\n", want: true},
+		{input: "YES\n", want: true},
+		{input: "n\n", def: true, want: false},
+		{input: "\n", def: true, want: true},
+		{input: "\n", def: false, want: false},
+		// Input that ends before an answer takes the default.
+		{input: "", def: true, want: true},
+		{input: "", def: false, want: false},
+		// A last line without a newline still counts.
+		{input: "y", want: true},
+	}
+	for _, tt := range tests {
+		got, err := NewTerminal(strings.NewReader(tt.input), io.Discard).Confirm("Continue?", tt.def)
+		if err != nil {
+			t.Errorf("Confirm(%q, %v): %v", tt.input, tt.def, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Confirm(%q, %v) = %v, want %v", tt.input, tt.def, got, tt.want)
+		}
+	}
+}
+
+func TestTerminalSelect(t *testing.T) {
+	options := []string{"a", "b", "c"}
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr error
+	}{
+		{input: "2\n", want: []string{"b"}},
+		{input: "3,1\n", want: []string{"c", "a"}},
+		{input: "1 2，2\n", want: []string{"a", "b"}},
+		{input: "\n", want: options},
+		{input: "all\n", want: options},
+		{input: "", wantErr: ErrNoInput},
+		{input: "4\n", wantErr: errAny},
+		{input: "x\n", wantErr: errAny},
+	}
+	for _, tt := range tests {
+		got, err := NewTerminal(strings.NewReader(tt.input), io.Discard).Select("Options:", "Pick", options)
+		switch {
+		case tt.wantErr == errAny && err != nil:
+		case tt.wantErr != nil:
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Select(%q): got %v, want %v", tt.input, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("Select(%q): %v", tt.input, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("Select(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+// errAny marks cases that only need to fail.
+var errAny = errors.New("any error")
+
+func TestUnattended(t *testing.T) {
+	for _, tt := range []struct {
+		assumeYes, def, want bool
+	}{
+		{false, false, false},
+		{false, true, true},
+		{true, false, true},
+		{true, true, true},
+	} {
+		got, err := Unattended{AssumeYes: tt.assumeYes}.Confirm("Continue?", tt.def)
+		if err != nil || got != tt.want {
+			t.Errorf("Unattended{AssumeYes: %v}.Confirm(def %v) = %v, %v; want %v",
+				tt.assumeYes, tt.def, got, err, tt.want)
+		}
+	}
+	if _, err := (Unattended{AssumeYes: true}).Select("Options:", "Pick", []string{"a"}); !errors.Is(err, ErrNonInteractive) {
+		t.Errorf("Unattended.Select: got %v, want ErrNonInteractive", err)
+	}
+}
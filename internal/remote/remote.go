@@ -0,0 +1,444 @@
+// Package remote reaches a server over SSH: commands run in a session and
+// files go through SFTP, so a deployment can be rendered on this machine and
+// installed on another one.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+	"github.com/rogeecn/sing-box-deploy/internal/runner"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultKeys are tried, when present, if no key file is configured.
+var defaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Config describes how to reach a host.
+type Config struct {
+	// Target is [user@]host[:port]; the user defaults to the local one and
+	// the port to 22.
+	Target string
+	// KeyFiles are private keys to authenticate with, in addition to the
+	// keys of a running ssh-agent. Empty means the default keys in ~/.ssh.
+	KeyFiles []string
+	// KnownHosts is the known_hosts file the host key must be listed in;
+	// defaults to ~/.ssh/known_hosts.
+	KnownHosts string
+	// Timeout bounds connecting and the SSH handshake; defaults to 15s.
+	Timeout time.Duration
+
+	// Auth and HostKeyCallback replace the agent, key files and
+	// known_hosts, e.g. for an in-process test server.
+	Auth            []ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// Client is a connection to a host. It implements runner.Runner and
+// fsys.FS.
+type Client struct {
+	name string
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+var (
+	_ runner.Runner = (*Client)(nil)
+	_ fsys.FS       = (*Client)(nil)
+)
+
+// ParseTarget splits [user@]host[:port], filling in the defaults.
+func ParseTarget(target string) (username, host, port string, err error) {
+	rest := target
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		username, rest = rest[:i], rest[i+1:]
+	}
+	host, port = rest, "22"
+	if h, p, err := net.SplitHostPort(rest); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(rest, "[") && strings.HasSuffix(rest, "]") {
+		host = rest[1 : len(rest)-1]
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("host %q: missing host name", target)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", "", fmt.Errorf("host %q: invalid port %q", target, port)
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", "", "", fmt.Errorf("host %q: no user given and the local one is unknown: %w", target, err)
+		}
+		username = u.Username
+	}
+	return username, host, port, nil
+}
+
+// CanonicalName returns target as user@host, with :port unless it is 22,
+// which is how the host is recorded in the state file.
+func CanonicalName(target string) (string, error) {
+	username, host, port, err := ParseTarget(target)
+	if err != nil {
+		return "", err
+	}
+	if port != "22" {
+		return username + "@" + net.JoinHostPort(host, port), nil
+	}
+	return username + "@" + host, nil
+}
+
+// Dial connects to the host and starts an SFTP session.
+func Dial(cfg Config) (*Client, error) {
+	username, host, port, err := ParseTarget(cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := CanonicalName(cfg.Target)
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 15 * time.Second
+	}
+	auth := cfg.Auth
+	if auth == nil {
+		if auth, err = authMethods(cfg.KeyFiles); err != nil {
+			return nil, err
+		}
+	}
+	hostKey := cfg.HostKeyCallback
+	if hostKey == nil {
+		if hostKey, err = knownHostsCallback(cfg.KnownHosts); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(host, port), &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", name, err)
+	}
+	sc, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("start sftp on %s: %w", name, err)
+	}
+	return &Client{name: name, ssh: conn, sftp: sc}, nil
+}
+
+// authMethods offers the keys of a running ssh-agent, then the key files.
+func authMethods(keyFiles []string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	explicit := len(keyFiles) > 0
+	if !explicit {
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range defaultKeys {
+				keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range keyFiles {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			if explicit {
+				return nil, fmt.Errorf("read ssh key: %w", err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			var missing *ssh.PassphraseMissingError
+			if !explicit && errors.As(err, &missing) {
+				// Encrypted keys are left to the agent.
+				continue
+			}
+			return nil, fmt.Errorf("parse ssh key %s: %w", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no ssh keys: start ssh-agent or pass --ssh-key")
+	}
+	return methods, nil
+}
+
+func knownHostsCallback(file string) (ssh.HostKeyCallback, error) {
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("locate known_hosts: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("read known_hosts: %w (connect once with ssh to record the host key)", err)
+	}
+	return callback, nil
+}
+
+// Name returns the host as user@host[:port].
+func (c *Client) Name() string { return c.name }
+
+// Close ends the SFTP and SSH sessions.
+func (c *Client) Close() error {
+	c.sftp.Close()
+	return c.ssh.Close()
+}
+
+// Run implements runner.Runner. The command is quoted for the login shell
+// of the remote user; a non-zero exit is reported as *ssh.ExitError.
+func (c *Client) Run(ctx context.Context, name string, args ...string) (runner.Result, error) {
+	session, err := c.ssh.NewSession()
+	if err != nil {
+		return runner.Result{}, fmt.Errorf("open session on %s: %w", c.name, err)
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+	err = session.Run(shellQuote(append([]string{name}, args...)))
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return runner.Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}, err
+}
+
+// DialContext connects to address as seen from the host, e.g. to probe a
+// listener bound to its loopback interface.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return c.ssh.DialContext(ctx, network, address)
+}
+
+// shellQuote joins argv for a POSIX shell, single-quoting every argument
+// that is not made of safe characters only.
+func shellQuote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,@%+") == "" {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func pathErr(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func unsupported(err error) bool {
+	var status *sftp.StatusError
+	return errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported
+}
+
+// ReadFile implements fsys.FS.
+func (c *Client) ReadFile(name string) ([]byte, error) {
+	f, err := c.sftp.Open(name)
+	if err != nil {
+		return nil, pathErr("open", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return data, pathErr("read", name, err)
+}
+
+// WriteFile implements fsys.FS.
+func (c *Client) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := c.sftp.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return pathErr("open", name, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return pathErr("write", name, err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return pathErr("chmod", name, err)
+	}
+	return pathErr("close", name, f.Close())
+}
+
+// ReadDir implements fsys.FS.
+func (c *Client) ReadDir(name string) ([]os.DirEntry, error) {
+	infos, err := c.sftp.ReadDir(name)
+	if err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	entries := make([]os.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+// Stat implements fsys.FS.
+func (c *Client) Stat(name string) (os.FileInfo, error) {
+	info, err := c.sftp.Stat(name)
+	return info, pathErr("stat", name, err)
+}
+
+// MkdirAll implements fsys.FS. Like os.MkdirAll, perm only applies to the
+// directory when it is created.
+func (c *Client) MkdirAll(name string, perm os.FileMode) error {
+	if info, err := c.sftp.Stat(name); err == nil {
+		if !info.IsDir() {
+			return pathErr("mkdir", name, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if err := c.sftp.MkdirAll(name); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	return pathErr("chmod", name, c.sftp.Chmod(name, perm|os.ModeDir))
+}
+
+// MkdirTemp implements fsys.FS; an empty dir means /tmp.
+func (c *Client) MkdirTemp(dir, pattern string) (string, error) {
+	if dir == "" {
+		dir = "/tmp"
+	}
+	for range 100 {
+		name := path.Join(dir, tempName(pattern))
+		err := c.sftp.Mkdir(name)
+		if err == nil {
+			return name, pathErr("chmod", name, c.sftp.Chmod(name, 0o700|os.ModeDir))
+		}
+		if _, statErr := c.sftp.Lstat(name); statErr != nil {
+			return "", pathErr("mkdirtemp", name, err)
+		}
+	}
+	return "", pathErr("mkdirtemp", path.Join(dir, pattern), fs.ErrExist)
+}
+
+// CreateTemp implements fsys.FS.
+func (c *Client) CreateTemp(dir, pattern string) (fsys.File, error) {
+	if dir == "" {
+		dir = "/tmp"
+	}
+	for range 100 {
+		name := path.Join(dir, tempName(pattern))
+		f, err := c.sftp.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+		if err == nil {
+			if err := f.Chmod(0o600); err != nil {
+				f.Close()
+				c.sftp.Remove(name)
+				return nil, pathErr("chmod", name, err)
+			}
+			return file{f}, nil
+		}
+		if _, statErr := c.sftp.Lstat(name); statErr != nil {
+			return nil, pathErr("createtemp", name, err)
+		}
+	}
+	return nil, pathErr("createtemp", path.Join(dir, pattern), fs.ErrExist)
+}
+
+// tempName replaces the last "*" in pattern with a random string, or
+// appends one, like os.CreateTemp.
+func tempName(pattern string) string {
+	var b [6]byte
+	rand.Read(b[:])
+	random := hex.EncodeToString(b[:])
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		return pattern[:i] + random + pattern[i+1:]
+	}
+	return pattern + random
+}
+
+// file makes Sync a no-op on servers without the fsync extension.
+type file struct{ *sftp.File }
+
+func (f file) Sync() error {
+	if err := f.File.Sync(); err != nil && !unsupported(err) {
+		return err
+	}
+	return nil
+}
+
+// Rename implements fsys.FS with the posix-rename extension, which replaces
+// newpath atomically; plain SFTP rename is used when the server lacks it.
+func (c *Client) Rename(oldpath, newpath string) error {
+	err := c.sftp.PosixRename(oldpath, newpath)
+	if unsupported(err) {
+		err = c.sftp.Rename(oldpath, newpath)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// Remove implements fsys.FS.
+func (c *Client) Remove(name string) error {
+	return pathErr("remove", name, c.sftp.Remove(name))
+}
+
+// RemoveAll implements fsys.FS; a missing name is not an error.
+func (c *Client) RemoveAll(name string) error {
+	err := c.sftp.RemoveAll(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return pathErr("removeall", name, err)
+}
+
+// Chown implements fsys.FS.
+func (c *Client) Chown(name string, uid, gid int) error {
+	return pathErr("chown", name, c.sftp.Chown(name, uid, gid))
+}
+
+// SyncDir implements fsys.FS; SFTP cannot sync directories.
+func (c *Client) SyncDir(string) {}
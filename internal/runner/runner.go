@@ -0,0 +1,48 @@
+// Package runner abstracts execution of external commands so callers can be
+// pointed at fake binaries or other hosts.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// Result holds the captured output of a command.
+type Result struct {
+	Stdout []byte
+	Stderr []byte
+}
+
+// Output returns stdout and stderr combined and trimmed for display.
+func (r Result) Output() string {
+	out := strings.TrimSpace(string(r.Stdout))
+	errOut := strings.TrimSpace(string(r.Stderr))
+	switch {
+	case out == "":
+		return errOut
+	case errOut == "":
+		return out
+	default:
+		return out + "\n" + errOut
+	}
+}
+
+// Runner executes a command and captures its output.
+type Runner interface {
+	Run(ctx context.Context, name string, args ...string) (Result, error)
+}
+
+// Local runs commands on the local machine.
+type Local struct{}
+
+// Run implements Runner.
+func (Local) Run(ctx context.Context, name string, args ...string) (Result, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}, err
+}
@@ -0,0 +1,244 @@
+// Package selftest proves each deployed inbound carries traffic by running a
+// sing-box client built from its share link against the local Caddy front.
+package selftest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+)
+
+// Result is the outcome of dialing through one inbound.
+type Result struct {
+	Tag       string        `json:"tag" yaml:"tag"`
+	OK        bool          `json:"ok" yaml:"ok"`
+	Skipped   bool          `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+	Latency   time.Duration `json:"-" yaml:"-"`
+	LatencyMS float64       `json:"latency_ms" yaml:"latency_ms"`
+	Error     string        `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Tester runs the self-test.
+type Tester struct {
+	// SingBoxBinary runs the temporary client; defaults to "sing-box".
+	SingBoxBinary string
+	// Address is the Caddy front the client connects to instead of resolving
+	// the domain; defaults to 127.0.0.1:443.
+	Address string
+	// Insecure skips verification of the certificate served by Caddy.
+	Insecure bool
+	// Timeout bounds each inbound test; defaults to 15s.
+	Timeout time.Duration
+	// BlockPrivate reports that the deployed route rejects private and
+	// loopback addresses. The test endpoint listens on loopback, so every
+	// inbound is reported as skipped instead of failed.
+	BlockPrivate bool
+}
+
+// blockPrivateReason is why inbounds are skipped under BlockPrivate.
+const blockPrivateReason = "route rejects private addresses (block_private), the loopback test endpoint is unreachable"
+
+// Run starts a local HTTP endpoint and requests it through every inbound.
+func (t *Tester) Run(ctx context.Context, inbounds []state.Inbound) ([]Result, error) {
+	if t.BlockPrivate {
+		results := make([]Result, 0, len(inbounds))
+		for _, inbound := range inbounds {
+			results = append(results, Result{Tag: inbound.Tag, Skipped: true, Error: blockPrivateReason})
+		}
+		return results, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	target, stop, err := serveToken(token)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	results := make([]Result, 0, len(inbounds))
+	for _, inbound := range inbounds {
+		start := time.Now()
+		err := t.dial(ctx, inbound, target, token)
+		elapsed := time.Since(start)
+		res := Result{
+			Tag:       inbound.Tag,
+			OK:        err == nil,
+			Latency:   elapsed,
+			LatencyMS: float64(elapsed.Microseconds()) / 1000,
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func (t *Tester) dial(ctx context.Context, inbound state.Inbound, target, token string) error {
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	link, err := share.ParseLink(inbound.ShareURL)
+	if err != nil {
+		return err
+	}
+	host, port, err := t.front()
+	if err != nil {
+		return err
+	}
+	link.Server = host
+	link.ServerPort = port
+
+	proxyPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	outbound := link.Outbound("proxy")
+	if tls, ok := outbound["tls"].(map[string]any); ok && t.Insecure {
+		tls["insecure"] = true
+	}
+	config := map[string]any{
+		"log": map[string]any{"level": "warn"},
+		"inbounds": []any{map[string]any{
+			"type":        "mixed",
+			"tag":         "selftest-in",
+			"listen":      "127.0.0.1",
+			"listen_port": proxyPort,
+		}},
+		"outbounds": []any{outbound},
+	}
+	dir, err := os.MkdirTemp("", "sing-box-selftest-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "client.json")
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(configPath, data, 0o600); err != nil {
+		return err
+	}
+
+	binary := t.SingBoxBinary
+	if binary == "" {
+		binary = "sing-box"
+	}
+	var output strings.Builder
+	client := exec.CommandContext(ctx, binary, "run", "-c", configPath)
+	client.Stdout = &output
+	client.Stderr = &output
+	if err := client.Start(); err != nil {
+		return fmt.Errorf("start sing-box client: %w", err)
+	}
+	defer func() {
+		client.Process.Kill()
+		client.Wait()
+	}()
+
+	proxyAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyPort))
+	if err := waitListening(ctx, proxyAddr); err != nil {
+		return fmt.Errorf("sing-box client did not start: %w (%s)", err, strings.TrimSpace(output.String()))
+	}
+	proxyURL := &url.URL{Scheme: "http", Host: proxyAddr}
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request through proxy: %w (%s)", err, strings.TrimSpace(output.String()))
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != token {
+		return fmt.Errorf("unexpected response %s %q", resp.Status, body)
+	}
+	return nil
+}
+
+func (t *Tester) front() (string, int, error) {
+	addr := t.Address
+	if addr == "" {
+		addr = "127.0.0.1:443"
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid front address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid front port %q", portStr)
+	}
+	return host, port, nil
+}
+
+// serveToken starts an HTTP server on loopback that answers with token.
+func serveToken(token string) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, token)
+	})}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String() + "/selftest", func() { srv.Close() }, nil
+}
+
+func waitListening(ctx context.Context, addr string) error {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 200*time.Millisecond)
+		if err == nil {
+			return conn.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func randomToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,43 @@
+package selftest
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+)
+
+func TestRunBlockPrivate(t *testing.T) {
+	inbounds := []state.Inbound{
+		{Tag: "vless-ws-tls", ShareURL: "vless://id@a.example.com:443?type=ws#a"},
+		{Tag: "vmess-h2-tls", ShareURL: "vmess://invalid"},
+	}
+	tester := &Tester{
+		// The route would reject the loopback endpoint, so no client runs.
+		SingBoxBinary: filepath.Join(t.TempDir(), "missing"),
+		BlockPrivate:  true,
+	}
+	results, err := tester.Run(context.Background(), inbounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(inbounds) {
+		t.Fatalf("got %d results, want %d", len(results), len(inbounds))
+	}
+	for i, res := range results {
+		if res.Tag != inbounds[i].Tag || res.OK || !res.Skipped || res.Error == "" {
+			t.Errorf("result %+v, want %s skipped with a reason", res, inbounds[i].Tag)
+		}
+	}
+
+	// Without block_private the same tester runs the client and fails.
+	tester.BlockPrivate = false
+	results, err = tester.Run(context.Background(), inbounds[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := results[0]; res.OK || res.Skipped {
+		t.Errorf("result %+v, want a failure for the missing sing-box", res)
+	}
+}
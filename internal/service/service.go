@@ -0,0 +1,404 @@
+// Package service installs the systemd units for sing-box and Caddy and
+// drives their lifecycle through systemctl.
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+	"github.com/rogeecn/sing-box-deploy/internal/runner"
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+	"github.com/rogeecn/sing-box-deploy/internal/templates"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
+)
+
+const (
+	SingBoxUnit = "sing-box.service"
+	CaddyUnit   = "caddy.service"
+
+	// RotateUnit runs `rotate --due`; RotateTimer triggers it hourly.
+	RotateUnit  = "sing-box-deploy-rotate.service"
+	RotateTimer = "sing-box-deploy-rotate.timer"
+
+	// DefaultCaddyFile is the path the packaged caddy.service already uses.
+	DefaultCaddyFile = "/etc/caddy/Caddyfile"
+	defaultUnitDir   = "/etc/systemd/system"
+	dropInName       = "sing-box-deploy.conf"
+
+	// logsRoot is where systemd's LogsDirectory= creates directories.
+	logsRoot            = "/var/log"
+	defaultLogrotateDir = "/etc/logrotate.d"
+	logrotateName       = "sing-box"
+)
+
+// Manager renders units into FS and runs systemctl through Runner; both
+// default to this machine.
+type Manager struct {
+	Runner runner.Runner
+	FS     fsys.FS
+	// Systemctl is the systemctl binary; defaults to "systemctl".
+	Systemctl string
+	// UnitDir is where units are written; defaults to /etc/systemd/system.
+	UnitDir string
+
+	SingBoxBinary string
+	CaddyBinary   string
+	RootDir       string
+	CaddyFile     string
+	// User runs sing-box as a dedicated account; empty uses DynamicUser.
+	User string
+	// Log is the sing-box log configuration. Install makes the log
+	// directory writable for the service and keeps the logrotate snippet
+	// in LogrotateDir (default /etc/logrotate.d) in line with it.
+	Log          singbox.Log
+	LogrotateDir string
+}
+
+func (m *Manager) applyDefaults() {
+	if m.Runner == nil {
+		m.Runner = runner.Local{}
+	}
+	if m.FS == nil {
+		m.FS = fsys.Local{}
+	}
+	if m.Systemctl == "" {
+		m.Systemctl = "systemctl"
+	}
+	if m.UnitDir == "" {
+		m.UnitDir = defaultUnitDir
+	}
+	if m.SingBoxBinary == "" {
+		m.SingBoxBinary = "sing-box"
+	}
+	if m.CaddyBinary == "" {
+		m.CaddyBinary = "caddy"
+	}
+	if m.LogrotateDir == "" {
+		m.LogrotateDir = defaultLogrotateDir
+	}
+}
+
+// UnitPath returns the location of the sing-box unit file.
+func (m *Manager) UnitPath() string {
+	m.applyDefaults()
+	return filepath.Join(m.UnitDir, SingBoxUnit)
+}
+
+// DropInPath returns the location of the Caddy drop-in.
+func (m *Manager) DropInPath() string {
+	m.applyDefaults()
+	return filepath.Join(m.UnitDir, CaddyUnit+".d", dropInName)
+}
+
+// Install writes the sing-box unit and, when the Caddyfile is not at the
+// packaged location, a caddy.service drop-in pointing at it. It reports
+// whether any unit file changed.
+func (m *Manager) Install(ctx context.Context) (bool, error) {
+	m.applyDefaults()
+	if m.RootDir == "" {
+		return false, fmt.Errorf("root directory is required")
+	}
+	logsDir, readWrite, err := m.prepareLogDir(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err := m.installLogrotate(ctx); err != nil {
+		return false, err
+	}
+	unit, err := templates.RenderSystemd(SingBoxUnit, struct {
+		Binary         string
+		RootDir        string
+		User           string
+		LogsDirectory  string
+		ReadWritePaths string
+	}{m.absBinary(ctx, m.SingBoxBinary), m.RootDir, m.User, logsDir, readWrite})
+	if err != nil {
+		return false, err
+	}
+	changed, err := m.writeIfChanged(m.UnitPath(), unit)
+	if err != nil {
+		return false, err
+	}
+
+	dropIn := m.DropInPath()
+	if m.CaddyFile == "" || m.CaddyFile == DefaultCaddyFile {
+		if _, err := m.FS.Stat(dropIn); err == nil {
+			if err := m.FS.Remove(dropIn); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+		return changed, nil
+	}
+	override, err := templates.RenderSystemd("caddy-override.conf", struct {
+		Binary    string
+		CaddyFile string
+	}{m.absBinary(ctx, m.CaddyBinary), m.CaddyFile})
+	if err != nil {
+		return false, err
+	}
+	dropInChanged, err := m.writeIfChanged(dropIn, override)
+	if err != nil {
+		return false, err
+	}
+	return changed || dropInChanged, nil
+}
+
+// prepareLogDir returns the LogsDirectory= or ReadWritePaths= value that
+// lets the sandboxed unit write its log file. Directories outside /var/log
+// are created here and handed to User, since a DynamicUser cannot be given
+// one.
+func (m *Manager) prepareLogDir(ctx context.Context) (logsDir, readWrite string, err error) {
+	file := m.Log.File()
+	if file == "" {
+		return "", "", nil
+	}
+	dir := filepath.Dir(file)
+	if rel, err := filepath.Rel(logsRoot, dir); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		// systemd creates the directory and chowns it to the service
+		// user on every start.
+		logsDir = rel
+	} else if m.User == "" {
+		return "", "", fmt.Errorf("log output %s is outside %s; set a service user to log there", file, logsRoot)
+	} else {
+		readWrite = dir
+	}
+	if m.User == "" {
+		return logsDir, readWrite, nil
+	}
+	if err := m.FS.MkdirAll(dir, 0o750); err != nil {
+		return "", "", fmt.Errorf("create log directory: %w", err)
+	}
+	if err := m.chownToUser(ctx, dir); err != nil {
+		return "", "", fmt.Errorf("chown log directory: %w", err)
+	}
+	return logsDir, readWrite, nil
+}
+
+// installLogrotate writes the logrotate snippet for the log file, or removes
+// it when sing-box logs to the journal.
+func (m *Manager) installLogrotate(ctx context.Context) error {
+	path := m.LogrotatePath()
+	file := m.Log.File()
+	if file == "" {
+		if err := m.FS.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	group := m.User
+	if m.User != "" {
+		if name, err := m.id(ctx, "-gn"); err == nil {
+			group = name
+		}
+	}
+	snippet, err := templates.RenderLogrotate(struct {
+		File   string
+		Rotate int
+		User   string
+		Group  string
+	}{file, m.Log.Keep(), m.User, group})
+	if err != nil {
+		return err
+	}
+	_, err = m.writeIfChanged(path, snippet)
+	return err
+}
+
+// LogrotatePath returns the location of the logrotate snippet.
+func (m *Manager) LogrotatePath() string {
+	m.applyDefaults()
+	return filepath.Join(m.LogrotateDir, logrotateName)
+}
+
+// Apply installs the units, reloads systemd when they changed and enables
+// sing-box. Unless restart is false it then restarts sing-box and Caddy.
+// Caddy is restarted rather than reloaded because the generated Caddyfile
+// disables the admin API that `caddy reload` relies on.
+func (m *Manager) Apply(ctx context.Context, restart bool) error {
+	changed, err := m.Install(ctx)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := m.systemctl(ctx, "daemon-reload"); err != nil {
+			return err
+		}
+	}
+	if err := m.systemctl(ctx, "enable", SingBoxUnit); err != nil {
+		return err
+	}
+	if !restart {
+		return nil
+	}
+	if err := m.systemctl(ctx, "restart", SingBoxUnit); err != nil {
+		return err
+	}
+	return m.systemctl(ctx, "restart", CaddyUnit)
+}
+
+// ReloadSingBox makes the running sing-box re-read its configuration; the
+// unit's ExecReload sends SIGHUP, which keeps Caddy and the unit untouched.
+func (m *Manager) ReloadSingBox(ctx context.Context) error {
+	m.applyDefaults()
+	return m.systemctl(ctx, "reload", SingBoxUnit)
+}
+
+// ScheduleRotation installs and starts the rotation timer running command,
+// whose first element is made absolute.
+func (m *Manager) ScheduleRotation(ctx context.Context, command []string) error {
+	m.applyDefaults()
+	if len(command) == 0 {
+		return fmt.Errorf("rotation command is required")
+	}
+	argv := append([]string{m.absBinary(ctx, command[0])}, command[1:]...)
+	unit, err := templates.RenderSystemd(RotateUnit, struct{ Command string }{QuoteCommand(argv)})
+	if err != nil {
+		return err
+	}
+	timer, err := templates.RenderSystemd(RotateTimer, nil)
+	if err != nil {
+		return err
+	}
+	unitChanged, err := m.writeIfChanged(filepath.Join(m.UnitDir, RotateUnit), unit)
+	if err != nil {
+		return err
+	}
+	timerChanged, err := m.writeIfChanged(m.TimerPath(), timer)
+	if err != nil {
+		return err
+	}
+	if unitChanged || timerChanged {
+		if err := m.systemctl(ctx, "daemon-reload"); err != nil {
+			return err
+		}
+	}
+	return m.systemctl(ctx, "enable", "--now", RotateTimer)
+}
+
+// UnscheduleRotation stops the rotation timer and removes its units.
+func (m *Manager) UnscheduleRotation(ctx context.Context) error {
+	m.applyDefaults()
+	if _, err := m.FS.Stat(m.TimerPath()); os.IsNotExist(err) {
+		return nil
+	}
+	if err := m.systemctl(ctx, "disable", "--now", RotateTimer); err != nil {
+		return err
+	}
+	for _, name := range []string{RotateTimer, RotateUnit} {
+		if err := m.FS.Remove(filepath.Join(m.UnitDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return m.systemctl(ctx, "daemon-reload")
+}
+
+// TimerPath returns the location of the rotation timer.
+func (m *Manager) TimerPath() string {
+	m.applyDefaults()
+	return filepath.Join(m.UnitDir, RotateTimer)
+}
+
+// QuoteCommand joins argv for systemd ExecStart lines and crontab entries,
+// double-quoting arguments that contain spaces or quotes.
+func QuoteCommand(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ActiveState returns the systemd ActiveState of unit, e.g. "active".
+func (m *Manager) ActiveState(ctx context.Context, unit string) (string, error) {
+	m.applyDefaults()
+	res, err := m.Runner.Run(ctx, m.Systemctl, "show", "--property=ActiveState", "--value", unit)
+	if err != nil {
+		return "", fmt.Errorf("systemctl show %s: %w (%s)", unit, err, res.Output())
+	}
+	return string(bytes.TrimSpace(res.Stdout)), nil
+}
+
+func (m *Manager) systemctl(ctx context.Context, args ...string) error {
+	res, err := m.Runner.Run(ctx, m.Systemctl, args...)
+	if err != nil {
+		return fmt.Errorf("systemctl %v: %w\n%s", args, err, res.Output())
+	}
+	return nil
+}
+
+func (m *Manager) writeIfChanged(path string, content []byte) (bool, error) {
+	current, err := m.FS.ReadFile(path)
+	if err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+	if err := m.FS.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+	if err := txn.WriteFileOn(m.FS, path, content, 0o644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// chownToUser hands path to User and its primary group.
+func (m *Manager) chownToUser(ctx context.Context, path string) error {
+	uid, err := m.id(ctx, "-u")
+	if err != nil {
+		return err
+	}
+	gid, err := m.id(ctx, "-g")
+	if err != nil {
+		return err
+	}
+	u, err := strconv.Atoi(uid)
+	if err != nil {
+		return err
+	}
+	g, err := strconv.Atoi(gid)
+	if err != nil {
+		return err
+	}
+	return m.FS.Chown(path, u, g)
+}
+
+// id runs `id <flag> User` where sing-box runs, which may be another host.
+func (m *Manager) id(ctx context.Context, flag string) (string, error) {
+	res, err := m.Runner.Run(ctx, "id", flag, m.User)
+	if err != nil {
+		return "", fmt.Errorf("look up user %s: %w (%s)", m.User, err, res.Output())
+	}
+	return string(bytes.TrimSpace(res.Stdout)), nil
+}
+
+// absBinary resolves name through PATH since systemd requires absolute
+// ExecStart paths; unresolvable names are returned unchanged. Remote hosts
+// are asked through their shell.
+func (m *Manager) absBinary(ctx context.Context, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	if _, ok := m.Runner.(runner.Local); !ok {
+		res, err := m.Runner.Run(ctx, "sh", "-c", `command -v "$1"`, "sh", name)
+		if path := string(bytes.TrimSpace(res.Stdout)); err == nil && filepath.IsAbs(path) {
+			return path
+		}
+		return name
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			return abs
+		}
+	}
+	return name
+}
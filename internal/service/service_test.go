@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rogeecn/sing-box-deploy/internal/runner"
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+)
+
+// recorder is a runner.Runner that records the commands it is asked to run.
+type recorder struct {
+	calls []string
+}
+
+func (r *recorder) Run(ctx context.Context, name string, args ...string) (runner.Result, error) {
+	r.calls = append(r.calls, strings.Join(append([]string{name}, args...), " "))
+	return runner.Result{}, nil
+}
+
+func testManager(t *testing.T, run runner.Runner) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	return &Manager{
+		Runner:        run,
+		UnitDir:       filepath.Join(dir, "systemd"),
+		LogrotateDir:  filepath.Join(dir, "logrotate.d"),
+		SingBoxBinary: "/usr/local/bin/sing-box",
+		CaddyBinary:   "/usr/bin/caddy",
+		RootDir:       "/etc/sing-box",
+		CaddyFile:     "/etc/sing-box/Caddyfile",
+	}
+}
+
+func TestApply(t *testing.T) {
+	first := []string{
+		"systemctl daemon-reload",
+		"systemctl enable sing-box.service",
+		"systemctl restart sing-box.service",
+		"systemctl restart caddy.service",
+	}
+	tests := []struct {
+		name    string
+		restart bool
+		// again applies a second time with unchanged units.
+		again bool
+		want  []string
+	}{
+		{name: "first install", restart: true, want: first},
+		{name: "unchanged units", restart: true, again: true, want: first[1:]},
+		{name: "no restart", restart: false, want: first[:2]},
+		{name: "no restart unchanged", restart: false, again: true, want: first[1:2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{}
+			m := testManager(t, rec)
+			if tt.again {
+				if err := m.Apply(context.Background(), tt.restart); err != nil {
+					t.Fatal(err)
+				}
+				rec.calls = nil
+			}
+			if err := m.Apply(context.Background(), tt.restart); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec.calls, tt.want) {
+				t.Errorf("commands:\n  %s\nwant:\n  %s", strings.Join(rec.calls, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+		})
+	}
+}
+
+func TestApplyWritesUnits(t *testing.T) {
+	m := testManager(t, &recorder{})
+	if err := m.Apply(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := os.ReadFile(m.UnitPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ExecStart=/usr/local/bin/sing-box -D /var/lib/sing-box -C /etc/sing-box run"; !strings.Contains(string(unit), want) {
+		t.Errorf("unit lacks %q:\n%s", want, unit)
+	}
+	dropIn, err := os.ReadFile(m.DropInPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dropIn), "/etc/sing-box/Caddyfile") {
+		t.Errorf("drop-in does not point at the Caddyfile:\n%s", dropIn)
+	}
+
+	// Moving back to the packaged Caddyfile drops the override.
+	m.CaddyFile = DefaultCaddyFile
+	rec := &recorder{}
+	m.Runner = rec
+	if err := m.Apply(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.DropInPath()); !os.IsNotExist(err) {
+		t.Errorf("drop-in still present: %v", err)
+	}
+	if len(rec.calls) == 0 || rec.calls[0] != "systemctl daemon-reload" {
+		t.Errorf("removing the drop-in did not reload systemd: %v", rec.calls)
+	}
+}
+
+func TestApplyServiceUser(t *testing.T) {
+	m := testManager(t, &recorder{})
+	m.User = "sing-box"
+	m.Log = singbox.Log{Output: singbox.LogJournald}
+	if err := m.Apply(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := os.ReadFile(m.UnitPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The group is the user's primary group, as for the log files.
+	if !strings.Contains(string(unit), "User=sing-box\n") || strings.Contains(string(unit), "Group=") {
+		t.Errorf("unit should set User= and leave the group to systemd:\n%s", unit)
+	}
+}
@@ -0,0 +1,87 @@
+package share
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultTestURL is fetched by the load-balancing groups to measure nodes.
+const DefaultTestURL = "https://www.gstatic.com/generate_204"
+
+const (
+	defaultTestInterval = 5 * time.Minute
+	// balanceTolerance is the latency difference in milliseconds below
+	// which url-test groups keep the current node.
+	balanceTolerance = 50
+
+	clashAuto     = "AUTO"
+	clashFallback = "FALLBACK"
+	singBoxAuto   = "auto"
+)
+
+// Balance configures the groups of a subscription spanning several nodes:
+// Clash gets a url-test (AUTO) and a fallback (FALLBACK) group, sing-box a
+// urltest outbound (auto) that the selector uses by default.
+type Balance struct {
+	// URL is fetched through every node; defaults to DefaultTestURL.
+	URL string
+	// Interval is the time between measurements; defaults to 5 minutes.
+	Interval time.Duration
+}
+
+func (b *Balance) url() string {
+	if b.URL == "" {
+		return DefaultTestURL
+	}
+	return b.URL
+}
+
+func (b *Balance) interval() time.Duration {
+	if b.Interval <= 0 {
+		return defaultTestInterval
+	}
+	return b.Interval
+}
+
+// RenderMerged renders the entries of several nodes in format, adding the
+// groups of balance to the Clash and sing-box formats.
+func RenderMerged(format, title string, entries []Entry, balance Balance) ([]byte, error) {
+	switch format {
+	case FormatClash:
+		return renderClash(entries, &balance)
+	case FormatSingBox:
+		return renderSingBox(entries, &balance)
+	default:
+		return RenderSubscription(format, title, entries)
+	}
+}
+
+// Duplicate is an entry dropped by Dedupe because Of, an earlier entry,
+// reaches the same endpoint.
+type Duplicate struct {
+	Entry
+	Of string
+}
+
+// Dedupe drops entries whose links differ only in their name from an
+// earlier entry, such as a node listed in two state files.
+func Dedupe(entries []Entry) ([]Entry, []Duplicate, error) {
+	seen := map[Link]string{}
+	var kept []Entry
+	var dropped []Duplicate
+	for _, e := range entries {
+		link, err := ParseLink(e.Link)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", e.Name, err)
+		}
+		link = link.withDefaults()
+		link.Name = ""
+		if of, ok := seen[link]; ok {
+			dropped = append(dropped, Duplicate{Entry: e, Of: of})
+			continue
+		}
+		seen[link] = e.Name
+		kept = append(kept, e)
+	}
+	return kept, dropped, nil
+}
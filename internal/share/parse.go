@@ -0,0 +1,190 @@
+package share
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rogeecn/sing-box-deploy/internal/spec"
+)
+
+// Link holds the client parameters carried by a share URL.
+type Link struct {
+	Protocol   string
+	Name       string
+	Server     string
+	ServerPort int
+	UUID       string
+	// Transport uses sing-box names: ws, httpupgrade or http.
+	Transport  string
+	Path       string
+	Host       string
+	ServerName string
+	TLS        bool
+
+	MaxEarlyData        int
+	EarlyDataHeaderName string
+}
+
+// ParseLink decodes a vless:// or vmess:// share URL.
+func ParseLink(raw string) (Link, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(raw, "vless://"):
+		return parseVLESS(raw)
+	case strings.HasPrefix(raw, "vmess://"):
+		return parseVMess(raw)
+	default:
+		return Link{}, fmt.Errorf("unsupported share link %q", raw)
+	}
+}
+
+func parseVLESS(raw string) (Link, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Link{}, fmt.Errorf("parse vless link: %w", err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return Link{}, fmt.Errorf("parse vless link: invalid port %q", u.Port())
+	}
+	q := u.Query()
+	link := Link{
+		Protocol:   "vless",
+		Name:       u.Fragment,
+		Server:     u.Hostname(),
+		ServerPort: port,
+		UUID:       u.User.Username(),
+		Transport:  singBoxTransport(q.Get("type")),
+		Host:       q.Get("host"),
+		ServerName: q.Get("sni"),
+		TLS:        q.Get("security") == "tls",
+	}
+	link.setPath(q.Get("path"))
+	return link.withDefaults(), nil
+}
+
+func parseVMess(raw string) (Link, error) {
+	payload := strings.TrimPrefix(raw, "vmess://")
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(payload); err != nil {
+			return Link{}, fmt.Errorf("decode vmess link: %w", err)
+		}
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Link{}, fmt.Errorf("decode vmess link: %w", err)
+	}
+	str := func(key string) string {
+		switch v := fields[key].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.Itoa(int(v))
+		default:
+			return ""
+		}
+	}
+	port, err := strconv.Atoi(str("port"))
+	if err != nil {
+		return Link{}, fmt.Errorf("decode vmess link: invalid port %q", str("port"))
+	}
+	link := Link{
+		Protocol:   "vmess",
+		Name:       str("ps"),
+		Server:     str("add"),
+		ServerPort: port,
+		UUID:       str("id"),
+		Transport:  singBoxTransport(str("net")),
+		Host:       str("host"),
+		ServerName: str("sni"),
+		TLS:        str("tls") == "tls",
+	}
+	link.setPath(str("path"))
+	return link.withDefaults(), nil
+}
+
+// setPath splits the `?ed=` early data hint off the client path.
+func (l *Link) setPath(path string) {
+	l.Path = path
+	base, query, ok := strings.Cut(path, "?")
+	if !ok {
+		return
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return
+	}
+	if ed, err := strconv.Atoi(values.Get("ed")); err == nil && ed > 0 {
+		l.Path = base
+		l.MaxEarlyData = ed
+		l.EarlyDataHeaderName = spec.DefaultEarlyDataHeaderName
+	}
+}
+
+func (l Link) withDefaults() Link {
+	if l.Host == "" {
+		l.Host = l.Server
+	}
+	if l.ServerName == "" {
+		l.ServerName = l.Host
+	}
+	return l
+}
+
+// Outbound renders the link as a sing-box outbound with the given tag.
+func (l Link) Outbound(tag string) map[string]any {
+	out := map[string]any{
+		"type":        l.Protocol,
+		"tag":         tag,
+		"server":      l.Server,
+		"server_port": l.ServerPort,
+		"uuid":        l.UUID,
+	}
+	if l.Protocol == "vmess" {
+		out["security"] = "auto"
+		out["alter_id"] = 0
+	}
+	if l.TLS {
+		tls := map[string]any{
+			"enabled":     true,
+			"server_name": l.ServerName,
+		}
+		if l.Transport == "http" {
+			tls["alpn"] = []string{"h2"}
+		}
+		out["tls"] = tls
+	}
+	transport := map[string]any{
+		"type": l.Transport,
+		"path": l.Path,
+	}
+	switch l.Transport {
+	case "ws":
+		transport["headers"] = map[string]any{"Host": l.Host}
+		if l.MaxEarlyData > 0 {
+			transport["max_early_data"] = l.MaxEarlyData
+			transport["early_data_header_name"] = l.EarlyDataHeaderName
+		}
+	case "httpupgrade":
+		transport["host"] = l.Host
+	case "http":
+		transport["host"] = []string{l.Host}
+	}
+	out["transport"] = transport
+	return out
+}
+
+// singBoxTransport maps share link network names to sing-box transports.
+func singBoxTransport(t string) string {
+	switch strings.ToLower(t) {
+	case "h2":
+		return "http"
+	default:
+		return strings.ToLower(t)
+	}
+}
@@ -1,9 +1,11 @@
 package share
 
 import (
+	"cmp"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/rogeecn/sing-box-deploy/internal/spec"
@@ -22,6 +24,7 @@ func BuildLink(inbound spec.InboundSpec, domain string) (string, error) {
 }
 
 func buildVMess(inbound spec.InboundSpec, domain string) string {
+	host := cmp.Or(inbound.Host, domain)
 	payload := map[string]string{
 		"v":    "2",
 		"ps":   inbound.Name,
@@ -31,22 +34,31 @@ func buildVMess(inbound spec.InboundSpec, domain string) string {
 		"aid":  "0",
 		"net":  transformTransport(inbound.Transport),
 		"type": "none",
-		"host": domain,
-		"path": inbound.Path,
+		"host": host,
+		"path": linkPath(inbound),
 		"tls":  "tls",
 	}
+	if host != domain {
+		payload["sni"] = domain
+	}
 	raw, _ := json.Marshal(payload)
 	encoded := base64.StdEncoding.EncodeToString(raw)
 	return "vmess://" + encoded
 }
 
 func buildVLESS(inbound spec.InboundSpec, domain string) string {
+	host := cmp.Or(inbound.Host, domain)
 	query := []string{
 		"encryption=none",
 		"security=tls",
 		fmt.Sprintf("type=%s", transformTransport(inbound.Transport)),
-		fmt.Sprintf("host=%s", domain),
-		fmt.Sprintf("path=%s", inbound.Path),
+		fmt.Sprintf("host=%s", host),
+		fmt.Sprintf("path=%s", url.QueryEscape(linkPath(inbound))),
+	}
+	if host != domain {
+		// Clients default the SNI to the host header, but the certificate
+		// is issued for the domain.
+		query = append(query, fmt.Sprintf("sni=%s", domain))
 	}
 	return fmt.Sprintf(
 		"vless://%s@%s:443?%s#%s",
@@ -57,6 +69,20 @@ func buildVLESS(inbound spec.InboundSpec, domain string) string {
 	)
 }
 
+// linkPath returns the client-side path, carrying the `?ed=` early data hint
+// for WebSocket inbounds that accept it. The hint implies the default
+// header, so an inbound reading early data from another header gets none
+// and its clients connect without early data.
+func linkPath(inbound spec.InboundSpec) string {
+	if inbound.Transport != "ws" || inbound.MaxEarlyData <= 0 {
+		return inbound.Path
+	}
+	if h := inbound.EarlyDataHeaderName; h != "" && !strings.EqualFold(h, spec.DefaultEarlyDataHeaderName) {
+		return inbound.Path
+	}
+	return fmt.Sprintf("%s?ed=%d", inbound.Path, inbound.MaxEarlyData)
+}
+
 func transformTransport(t string) string {
 	switch strings.ToLower(t) {
 	case "http":
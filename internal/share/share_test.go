@@ -0,0 +1,141 @@
+package share_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rogeecn/sing-box-deploy/internal/share"
+	"github.com/rogeecn/sing-box-deploy/internal/spec"
+	"github.com/rogeecn/sing-box-deploy/internal/templates"
+)
+
+const domain = "a.example.com"
+
+// TestWebSocketEarlyDataRoundTrip renders the WebSocket inbounds and checks
+// that the share link and the Clash proxy built from it carry the early data
+// the server accepts.
+func TestWebSocketEarlyDataRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		header string
+		// wantLink is the early data a client learns from the link.
+		wantLink int
+	}{
+		{name: "default", size: spec.DefaultMaxEarlyData, header: spec.DefaultEarlyDataHeaderName, wantLink: spec.DefaultMaxEarlyData},
+		{name: "custom size", size: 4096, header: spec.DefaultEarlyDataHeaderName, wantLink: 4096},
+		{name: "disabled", size: 0, header: "", wantLink: 0},
+		{name: "custom header", size: 2048, header: "X-Early-Data", wantLink: 0},
+	}
+	for _, key := range []string{"vless-ws-tls", "vmess-ws-tls"} {
+		for _, tt := range tests {
+			t.Run(key+"/"+tt.name, func(t *testing.T) {
+				inbound, err := spec.BuildSpec(key, domain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				inbound.ListenPort = 40000
+				inbound.MaxEarlyData = tt.size
+				inbound.EarlyDataHeaderName = tt.header
+
+				transport := renderTransport(t, inbound)
+				if got := intField(transport["max_early_data"]); got != tt.size {
+					t.Errorf("max_early_data = %d, want %d", got, tt.size)
+				}
+				if got, _ := transport["early_data_header_name"].(string); got != tt.header {
+					t.Errorf("early_data_header_name = %q, want %q", got, tt.header)
+				}
+				if got, _ := transport["path"].(string); got != inbound.Path {
+					t.Errorf("server path = %q, want %q", got, inbound.Path)
+				}
+
+				raw, err := share.BuildLink(inbound, domain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				link, err := share.ParseLink(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if link.Path != inbound.Path {
+					t.Errorf("link path = %q, want %q", link.Path, inbound.Path)
+				}
+				if link.MaxEarlyData != tt.wantLink {
+					t.Errorf("link early data = %d, want %d", link.MaxEarlyData, tt.wantLink)
+				}
+				if tt.wantLink > 0 && link.EarlyDataHeaderName != tt.header {
+					t.Errorf("link early data header = %q, want %q", link.EarlyDataHeaderName, tt.header)
+				}
+				if link.UUID != inbound.UUID || link.Server != domain || link.Transport != "ws" || !link.TLS {
+					t.Errorf("link = %+v, want %s over ws+tls to %s", link, inbound.UUID, domain)
+				}
+
+				wsOpts, ok := share.ClashProxy(inbound.Tag, link)["ws-opts"].(map[string]any)
+				if !ok {
+					t.Fatal("clash proxy has no ws-opts")
+				}
+				if got, _ := wsOpts["path"].(string); got != inbound.Path {
+					t.Errorf("clash path = %q, want %q", got, inbound.Path)
+				}
+				if got, _ := wsOpts["max-early-data"].(int); got != tt.wantLink {
+					t.Errorf("clash max-early-data = %d, want %d", got, tt.wantLink)
+				}
+				header, hasHeader := wsOpts["early-data-header-name"].(string)
+				if tt.wantLink > 0 && header != tt.header {
+					t.Errorf("clash early-data-header-name = %q, want %q", header, tt.header)
+				}
+				if tt.wantLink == 0 && hasHeader {
+					t.Errorf("clash early-data-header-name = %q without early data", header)
+				}
+			})
+		}
+	}
+}
+
+func TestBuildLinkHostOverride(t *testing.T) {
+	for _, key := range []string{"vless-ws-tls", "vmess-h2-tls"} {
+		t.Run(key, func(t *testing.T) {
+			inbound, err := spec.BuildSpec(key, domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inbound.Host = "cdn.example.net"
+			raw, err := share.BuildLink(inbound, domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, err := share.ParseLink(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.Server != domain || link.Host != inbound.Host || link.ServerName != domain {
+				t.Errorf("server %s, host %s, sni %s; want %s, %s, %s",
+					link.Server, link.Host, link.ServerName, domain, inbound.Host, domain)
+			}
+		})
+	}
+}
+
+// renderTransport renders inbound alone and returns its transport object.
+func renderTransport(t *testing.T, inbound spec.InboundSpec) map[string]any {
+	t.Helper()
+	rendered, err := templates.RenderInbounds(templates.Data{
+		Domain:   domain,
+		Inbounds: map[string]spec.InboundSpec{inbound.Key: inbound},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Transport map[string]any `json:"transport"`
+	}
+	if err := json.Unmarshal(rendered[inbound.Key], &doc); err != nil {
+		t.Fatalf("rendered inbound is not JSON: %v\n%s", err, rendered[inbound.Key])
+	}
+	return doc.Transport
+}
+
+func intField(v any) int {
+	f, _ := v.(float64)
+	return int(f)
+}
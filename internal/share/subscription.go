@@ -0,0 +1,205 @@
+package share
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Subscription formats.
+const (
+	FormatText    = "text"
+	FormatBase64  = "base64"
+	FormatClash   = "clash"
+	FormatSingBox = "sing-box"
+)
+
+// Formats lists every supported subscription format.
+var Formats = []string{FormatText, FormatBase64, FormatClash, FormatSingBox}
+
+// Entry is a single node in a subscription.
+type Entry struct {
+	Name string
+	Link string
+}
+
+// ValidFormat reports whether format is supported.
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// FileName returns the subscription file name of format for domain. The text
+// format keeps the historical <domain>.txt name.
+func FileName(domain, format string) string {
+	switch format {
+	case FormatBase64:
+		return domain + ".base64.txt"
+	case FormatClash:
+		return domain + ".clash.yaml"
+	case FormatSingBox:
+		return domain + ".sing-box.json"
+	default:
+		return domain + ".txt"
+	}
+}
+
+// NodeEntryName names an inbound in a subscription spanning several nodes:
+// the node name followed by the inbound tag without its domain suffix.
+func NodeEntryName(node, tag, domain string) string {
+	return node + "-" + strings.TrimSuffix(tag, "-"+domain)
+}
+
+// RenderSubscription renders entries in the given format. title is used by
+// formats that carry a header.
+func RenderSubscription(format, title string, entries []Entry) ([]byte, error) {
+	switch format {
+	case FormatText:
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("# Subscriptions for %s\n\n", title))
+		for _, e := range entries {
+			b.WriteString(fmt.Sprintf("[%s]\n%s\n\n", e.Name, e.Link))
+		}
+		return []byte(b.String()), nil
+	case FormatBase64:
+		links := make([]string, 0, len(entries))
+		for _, e := range entries {
+			links = append(links, e.Link)
+		}
+		return []byte(base64.StdEncoding.EncodeToString([]byte(strings.Join(links, "\n")))), nil
+	case FormatClash:
+		return renderClash(entries, nil)
+	case FormatSingBox:
+		return renderSingBox(entries, nil)
+	default:
+		return nil, fmt.Errorf("unsupported subscription format %q", format)
+	}
+}
+
+func renderClash(entries []Entry, balance *Balance) ([]byte, error) {
+	proxies := make([]map[string]any, 0, len(entries))
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		link, err := ParseLink(e.Link)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, ClashProxy(e.Name, link))
+		names = append(names, e.Name)
+	}
+	groups := []map[string]any{{
+		"name":    "PROXY",
+		"type":    "select",
+		"proxies": names,
+	}}
+	if balance != nil {
+		groups[0]["proxies"] = append([]string{clashAuto, clashFallback}, names...)
+		for _, group := range []struct{ name, typ string }{{clashAuto, "url-test"}, {clashFallback, "fallback"}} {
+			g := map[string]any{
+				"name":     group.name,
+				"type":     group.typ,
+				"proxies":  names,
+				"url":      balance.url(),
+				"interval": int(balance.interval().Seconds()),
+			}
+			if group.typ == "url-test" {
+				g["tolerance"] = balanceTolerance
+			}
+			groups = append(groups, g)
+		}
+	}
+	doc := map[string]any{
+		"proxies":      proxies,
+		"proxy-groups": groups,
+		"rules":        []string{"MATCH,PROXY"},
+	}
+	return yaml.Marshal(doc)
+}
+
+// ClashProxy renders link as a Clash (mihomo) proxy entry named name.
+func ClashProxy(name string, link Link) map[string]any {
+	proxy := map[string]any{
+		"name":   name,
+		"type":   link.Protocol,
+		"server": link.Server,
+		"port":   link.ServerPort,
+		"uuid":   link.UUID,
+		"udp":    true,
+	}
+	if link.Protocol == "vmess" {
+		proxy["alterId"] = 0
+		proxy["cipher"] = "auto"
+	}
+	if link.TLS {
+		proxy["tls"] = true
+		proxy["servername"] = link.ServerName
+	}
+	switch link.Transport {
+	case "ws", "httpupgrade":
+		proxy["network"] = "ws"
+		opts := map[string]any{
+			"path":    link.Path,
+			"headers": map[string]string{"Host": link.Host},
+		}
+		if link.Transport == "httpupgrade" {
+			opts["v2ray-http-upgrade"] = true
+		}
+		if link.MaxEarlyData > 0 {
+			opts["max-early-data"] = link.MaxEarlyData
+			opts["early-data-header-name"] = link.EarlyDataHeaderName
+		}
+		proxy["ws-opts"] = opts
+	case "http":
+		proxy["network"] = "h2"
+		proxy["h2-opts"] = map[string]any{
+			"host": []string{link.Host},
+			"path": link.Path,
+		}
+	}
+	return proxy
+}
+
+func renderSingBox(entries []Entry, balance *Balance) ([]byte, error) {
+	outbounds := make([]any, 0, len(entries)+2)
+	tags := make([]string, 0, len(entries))
+	for _, e := range entries {
+		link, err := ParseLink(e.Link)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, e.Name)
+		outbounds = append(outbounds, link.Outbound(e.Name))
+	}
+	selector := map[string]any{
+		"type":      "selector",
+		"tag":       "proxy",
+		"outbounds": tags,
+	}
+	head := []any{selector}
+	if balance != nil {
+		selector["outbounds"] = append([]string{singBoxAuto}, tags...)
+		selector["default"] = singBoxAuto
+		head = append(head, map[string]any{
+			"type":      "urltest",
+			"tag":       singBoxAuto,
+			"outbounds": tags,
+			"url":       balance.url(),
+			"interval":  balance.interval().String(),
+			"tolerance": balanceTolerance,
+		})
+	}
+	outbounds = append(head, outbounds...)
+	outbounds = append(outbounds, map[string]any{"type": "direct", "tag": "direct"})
+	data, err := json.MarshalIndent(map[string]any{"outbounds": outbounds}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,164 @@
+// Package singbox renders the shared 00_common.json configuration: logging,
+// outbounds, routing and DNS that apply to every inbound on the host.
+package singbox
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+)
+
+// Common holds the settings rendered into 00_common.json. The zero value
+// produces the historical defaults.
+type Common struct {
+	Log     Log     `json:"log" yaml:"log,omitempty"`
+	Routing Routing `json:"routing" yaml:"routing,omitempty"`
+	DNS     DNS     `json:"dns" yaml:"dns,omitempty"`
+	// Outbounds are added after the built-in direct and block outbounds.
+	Outbounds []Outbound `json:"outbounds,omitempty" yaml:"outbounds,omitempty"`
+	Stats     Stats      `json:"stats" yaml:"stats,omitempty"`
+}
+
+// Validate checks the settings for dangling references.
+func (c Common) Validate() error {
+	tags := make([]string, 0, len(c.Outbounds))
+	seen := map[string]struct{}{}
+	for i, o := range c.Outbounds {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("outbounds[%d]: %w", i, err)
+		}
+		if _, ok := seen[o.Tag]; ok {
+			return fmt.Errorf("outbound %s is defined twice", o.Tag)
+		}
+		seen[o.Tag] = struct{}{}
+		tags = append(tags, o.Tag)
+	}
+	if err := c.Log.validate(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	extra := c.DNS.ruleSetRules()
+	if err := c.Routing.validate(extra, tags); err != nil {
+		return fmt.Errorf("routing: %w", err)
+	}
+	sets := map[string]struct{}{}
+	for _, s := range c.Routing.ruleSets(extra...) {
+		sets[s.Tag] = struct{}{}
+	}
+	if err := c.DNS.validate(sets); err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	if err := c.Stats.validate(); err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	return nil
+}
+
+// CheckFiles checks that the local rule-set files exist on target, the
+// filesystem of the host sing-box runs on.
+func (c Common) CheckFiles(target fsys.FS) error {
+	for _, s := range c.Routing.ruleSets(c.DNS.ruleSetRules()...) {
+		if s.kind() != "local" {
+			continue
+		}
+		if _, err := target.Stat(s.Path); err != nil {
+			return fmt.Errorf("routing: rule-set %s: %w", s.Tag, err)
+		}
+	}
+	return nil
+}
+
+// Render returns the 00_common.json document. counters lists what the V2Ray
+// API counts when it is enabled.
+func (c Common) Render(counters Counters) ([]byte, error) {
+	payload := map[string]any{
+		"log":   c.Log.render(),
+		"route": c.Routing.render(c.DNS.ruleSetRules()...),
+	}
+	outbounds := []map[string]any{
+		{
+			"type": "direct",
+			"tag":  OutboundDirect,
+		},
+		{
+			"type": "block",
+			"tag":  OutboundBlock,
+		},
+	}
+	var endpoints []map[string]any
+	for _, o := range c.Outbounds {
+		if entry, endpoint := o.render(); endpoint {
+			endpoints = append(endpoints, entry)
+		} else {
+			outbounds = append(outbounds, entry)
+		}
+	}
+	payload["outbounds"] = outbounds
+	if len(endpoints) > 0 {
+		payload["endpoints"] = endpoints
+	}
+	if dns := c.DNS.render(); dns != nil {
+		payload["dns"] = dns
+	}
+	if experimental := c.Stats.render(counters); experimental != nil {
+		payload["experimental"] = experimental
+	}
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// Outbound returns the additional outbound tagged tag.
+func (c Common) Outbound(tag string) (Outbound, bool) {
+	for _, o := range c.Outbounds {
+		if o.Tag == tag {
+			return o, true
+		}
+	}
+	return Outbound{}, false
+}
+
+// RemoveOutbound drops the outbound tagged tag together with the routing
+// rules that use it. A final or download detour pointing at it falls back
+// to direct. It reports whether the outbound existed.
+func (c *Common) RemoveOutbound(tag string) bool {
+	found := false
+	kept := c.Outbounds[:0]
+	for _, o := range c.Outbounds {
+		if o.Tag == tag {
+			found = true
+			continue
+		}
+		kept = append(kept, o)
+	}
+	c.Outbounds = kept
+	if !found {
+		return false
+	}
+	c.RemoveRules(tag)
+	if c.Routing.Final == tag {
+		c.Routing.Final = ""
+	}
+	if c.Routing.DownloadDetour == tag {
+		c.Routing.DownloadDetour = ""
+	}
+	for i := range c.Routing.RuleSets {
+		if c.Routing.RuleSets[i].DownloadDetour == tag {
+			c.Routing.RuleSets[i].DownloadDetour = ""
+		}
+	}
+	return true
+}
+
+// RemoveRules drops the routing rules that send traffic to tag.
+func (c *Common) RemoveRules(tag string) {
+	rules := c.Routing.Rules[:0]
+	for _, rule := range c.Routing.Rules {
+		if rule.Outbound != tag {
+			rules = append(rules, rule)
+		}
+	}
+	c.Routing.Rules = rules
+}
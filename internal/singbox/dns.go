@@ -0,0 +1,276 @@
+package singbox
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DNSLocal is the tag of the system resolver, available to DNS rules and
+// used to resolve upstreams given by host name.
+const DNSLocal = "local"
+
+// DNS strategies accepted by sing-box.
+var dnsStrategies = map[string]struct{}{
+	"prefer_ipv4": {}, "prefer_ipv6": {}, "ipv4_only": {}, "ipv6_only": {},
+}
+
+// DNS controls the dns section. The zero value leaves it out so sing-box
+// uses the system resolver.
+type DNS struct {
+	// Preset supplies the upstream servers and final server when Servers is
+	// empty; see DNSPresets.
+	Preset  string      `json:"preset,omitempty" yaml:"preset,omitempty"`
+	Servers []DNSServer `json:"servers,omitempty" yaml:"servers,omitempty"`
+	Rules   []DNSRule   `json:"rules,omitempty" yaml:"rules,omitempty"`
+	// Final is the server used when no rule matches; defaults to the first
+	// server.
+	Final string `json:"final,omitempty" yaml:"final,omitempty"`
+	// Strategy is prefer_ipv4, prefer_ipv6, ipv4_only or ipv6_only.
+	Strategy      string `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+	DisableCache  bool   `json:"disable_cache,omitempty" yaml:"disable_cache,omitempty"`
+	CacheCapacity int    `json:"cache_capacity,omitempty" yaml:"cache_capacity,omitempty"`
+}
+
+// DNSServer is an upstream resolver.
+type DNSServer struct {
+	Tag string `json:"tag" yaml:"tag"`
+	// Address selects the protocol by scheme: https://1.1.1.1/dns-query (DoH),
+	// tls://8.8.8.8 (DoT), quic://dns.adguard-dns.com (DoQ), h3://, udp://,
+	// tcp:// or a bare IP for plain DNS, or "local" for the system resolver.
+	Address string `json:"address" yaml:"address"`
+}
+
+// DNSRule sends matching queries to Server.
+type DNSRule struct {
+	Domain       []string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	DomainSuffix []string `json:"domain_suffix,omitempty" yaml:"domain_suffix,omitempty"`
+	RuleSet      []string `json:"rule_set,omitempty" yaml:"rule_set,omitempty"`
+	// Geosite names SagerNet rule-sets, added to the route like the
+	// routing rule shorthand.
+	Geosite []string `json:"geosite,omitempty" yaml:"geosite,omitempty"`
+	Server  string   `json:"server" yaml:"server"`
+}
+
+// DNSPresets are the upstream sets selectable with `deploy --dns`.
+var DNSPresets = map[string][]DNSServer{
+	"cloudflare": {
+		{Tag: "cloudflare", Address: "https://1.1.1.1/dns-query"},
+		{Tag: "cloudflare-backup", Address: "https://1.0.0.1/dns-query"},
+	},
+	"google": {
+		{Tag: "google", Address: "https://8.8.8.8/dns-query"},
+		{Tag: "google-backup", Address: "https://8.8.4.4/dns-query"},
+	},
+	"quad9": {
+		{Tag: "quad9", Address: "tls://9.9.9.9"},
+		{Tag: "quad9-backup", Address: "tls://149.112.112.112"},
+	},
+	"adguard": {
+		{Tag: "adguard", Address: "quic://94.140.14.14"},
+		{Tag: "adguard-backup", Address: "quic://94.140.15.15"},
+	},
+	"local": {
+		{Tag: DNSLocal, Address: "local"},
+	},
+}
+
+// DNSPresetNames returns the preset names in sorted order.
+func DNSPresetNames() []string {
+	names := make([]string, 0, len(DNSPresets))
+	for name := range DNSPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d DNS) enabled() bool {
+	return d.Preset != "" || len(d.Servers) > 0
+}
+
+func (d DNS) servers() []DNSServer {
+	if len(d.Servers) > 0 {
+		return d.Servers
+	}
+	return DNSPresets[d.Preset]
+}
+
+// ruleSetRules expresses the rule-set references of the DNS rules as route
+// rules so the route section declares the rule-sets they need.
+func (d DNS) ruleSetRules() []Rule {
+	var rules []Rule
+	for _, rule := range d.Rules {
+		if len(rule.RuleSet) > 0 || len(rule.Geosite) > 0 {
+			rules = append(rules, Rule{RuleSet: rule.RuleSet, Geosite: rule.Geosite})
+		}
+	}
+	return rules
+}
+
+// validate checks servers and rules; ruleSets are the tags declared in the
+// route section.
+func (d DNS) validate(ruleSets map[string]struct{}) error {
+	if !d.enabled() {
+		if len(d.Rules) > 0 || d.Final != "" || d.Strategy != "" {
+			return fmt.Errorf("no servers or preset configured")
+		}
+		return nil
+	}
+	if d.Preset != "" {
+		if _, ok := DNSPresets[d.Preset]; !ok {
+			return fmt.Errorf("unknown preset %q (want one of %s)", d.Preset, strings.Join(DNSPresetNames(), ", "))
+		}
+	}
+	if d.Strategy != "" {
+		if _, ok := dnsStrategies[d.Strategy]; !ok {
+			return fmt.Errorf("unknown strategy %q", d.Strategy)
+		}
+	}
+	if d.CacheCapacity < 0 {
+		return fmt.Errorf("cache_capacity must not be negative")
+	}
+	tags := map[string]struct{}{DNSLocal: {}}
+	for i, server := range d.servers() {
+		if server.Tag == "" {
+			return fmt.Errorf("servers[%d]: tag is required", i)
+		}
+		if _, ok := tags[server.Tag]; ok && server.Tag != DNSLocal {
+			return fmt.Errorf("server %s: duplicate tag", server.Tag)
+		}
+		tags[server.Tag] = struct{}{}
+		if _, err := server.render(); err != nil {
+			return fmt.Errorf("server %s: %w", server.Tag, err)
+		}
+	}
+	if d.Final != "" {
+		if _, ok := tags[d.Final]; !ok {
+			return fmt.Errorf("final: unknown server %q", d.Final)
+		}
+	}
+	for i, rule := range d.Rules {
+		if len(rule.Domain)+len(rule.DomainSuffix)+len(rule.RuleSet)+len(rule.Geosite) == 0 {
+			return fmt.Errorf("rules[%d]: no match conditions", i)
+		}
+		if _, ok := tags[rule.Server]; !ok {
+			return fmt.Errorf("rules[%d]: unknown server %q", i, rule.Server)
+		}
+		refs := append([]string{}, rule.RuleSet...)
+		for _, name := range rule.Geosite {
+			refs = append(refs, "geosite-"+name)
+		}
+		for _, tag := range refs {
+			if _, ok := ruleSets[tag]; !ok {
+				return fmt.Errorf("rules[%d]: unknown rule-set %q", i, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// render returns the dns section, or nil when DNS is not configured.
+func (d DNS) render() map[string]any {
+	if !d.enabled() {
+		return nil
+	}
+	servers := d.servers()
+	needLocal := false
+	rendered := make([]map[string]any, 0, len(servers)+1)
+	hasLocal := false
+	for _, server := range servers {
+		entry, _ := server.render()
+		if _, ok := entry["domain_resolver"]; ok {
+			needLocal = true
+		}
+		if entry["type"] == "local" && server.Tag == DNSLocal {
+			hasLocal = true
+		}
+		rendered = append(rendered, entry)
+	}
+	var rules []map[string]any
+	for _, rule := range d.Rules {
+		needLocal = needLocal || rule.Server == DNSLocal
+		entry := map[string]any{"server": rule.Server}
+		if len(rule.Domain) > 0 {
+			entry["domain"] = rule.Domain
+		}
+		if len(rule.DomainSuffix) > 0 {
+			entry["domain_suffix"] = rule.DomainSuffix
+		}
+		refs := append([]string{}, rule.RuleSet...)
+		for _, name := range rule.Geosite {
+			refs = append(refs, "geosite-"+name)
+		}
+		if len(refs) > 0 {
+			entry["rule_set"] = refs
+		}
+		rules = append(rules, entry)
+	}
+	if (needLocal || d.Final == DNSLocal) && !hasLocal {
+		rendered = append(rendered, map[string]any{"type": "local", "tag": DNSLocal})
+	}
+
+	final := d.Final
+	if final == "" {
+		final = servers[0].Tag
+	}
+	out := map[string]any{
+		"servers": rendered,
+		"final":   final,
+	}
+	if len(rules) > 0 {
+		out["rules"] = rules
+	}
+	if d.Strategy != "" {
+		out["strategy"] = d.Strategy
+	}
+	if d.DisableCache {
+		out["disable_cache"] = true
+	}
+	if d.CacheCapacity > 0 {
+		out["cache_capacity"] = d.CacheCapacity
+	}
+	return out
+}
+
+// render converts the address into a typed sing-box DNS server.
+func (s DNSServer) render() (map[string]any, error) {
+	if s.Address == "local" {
+		return map[string]any{"type": "local", "tag": s.Tag}, nil
+	}
+	address := s.Address
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid address %q", s.Address)
+	}
+	kinds := map[string]string{"https": "https", "tls": "tls", "quic": "quic", "h3": "h3", "udp": "udp", "tcp": "tcp"}
+	kind, ok := kinds[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported scheme %q in %q", u.Scheme, s.Address)
+	}
+	entry := map[string]any{
+		"type":   kind,
+		"tag":    s.Tag,
+		"server": u.Hostname(),
+	}
+	if port := u.Port(); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %q", s.Address)
+		}
+		entry["server_port"] = n
+	}
+	if (kind == "https" || kind == "h3") && u.Path != "" && u.Path != "/dns-query" {
+		entry["path"] = u.Path
+	}
+	if net.ParseIP(u.Hostname()) == nil {
+		entry["domain_resolver"] = DNSLocal
+	}
+	return entry, nil
+}
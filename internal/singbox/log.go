@@ -0,0 +1,92 @@
+package singbox
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	// DefaultLogFile is where sing-box logs unless told otherwise.
+	DefaultLogFile = "/var/log/sing-box/sing-box.log"
+	// LogJournald sends the log to stderr, which systemd stores in the
+	// journal.
+	LogJournald = "journald"
+
+	defaultLogLevel  = "info"
+	defaultLogRotate = 7
+)
+
+var logLevels = map[string]struct{}{
+	"trace": {}, "debug": {}, "info": {}, "warn": {}, "error": {}, "fatal": {}, "panic": {},
+}
+
+// Log configures sing-box logging. The zero value logs at info level with
+// timestamps to DefaultLogFile.
+type Log struct {
+	// Level is trace, debug, info (default), warn, error, fatal or panic.
+	Level string `json:"level,omitempty" yaml:"level,omitempty"`
+	// Output is an absolute log file path or "journald".
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+	// Timestamp prefixes entries with the time; defaults to true for files
+	// and false for journald, which records the time itself.
+	Timestamp *bool `json:"timestamp,omitempty" yaml:"timestamp,omitempty"`
+	// Rotate is the number of daily rotated files logrotate keeps;
+	// defaults to 7.
+	Rotate int `json:"rotate,omitempty" yaml:"rotate,omitempty"`
+}
+
+// File returns the log file, or "" when logging to journald.
+func (l Log) File() string {
+	switch l.Output {
+	case "":
+		return DefaultLogFile
+	case LogJournald:
+		return ""
+	default:
+		return l.Output
+	}
+}
+
+// Keep returns how many rotated files are kept.
+func (l Log) Keep() int {
+	if l.Rotate > 0 {
+		return l.Rotate
+	}
+	return defaultLogRotate
+}
+
+func (l Log) validate() error {
+	if _, ok := logLevels[l.Level]; l.Level != "" && !ok {
+		return fmt.Errorf("unknown level %q (want trace, debug, info, warn, error, fatal or panic)", l.Level)
+	}
+	if l.Output != "" && l.Output != LogJournald && !filepath.IsAbs(l.Output) {
+		return fmt.Errorf("output %q must be an absolute path or %s", l.Output, LogJournald)
+	}
+	if l.Rotate < 0 {
+		return fmt.Errorf("rotate must not be negative")
+	}
+	return nil
+}
+
+func (l Log) render() map[string]any {
+	level := l.Level
+	if level == "" {
+		level = defaultLogLevel
+	}
+	file := l.File()
+	timestamp := file != ""
+	if l.Timestamp != nil {
+		timestamp = *l.Timestamp
+	}
+	out := map[string]any{
+		"level":     level,
+		"timestamp": timestamp,
+	}
+	if file != "" {
+		out["output"] = file
+	} else {
+		// sing-box colours stderr, which would end up in the journal.
+		out["disable_color"] = true
+	}
+	return out
+}
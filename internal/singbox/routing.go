@@ -0,0 +1,329 @@
+package singbox
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// Outbound tags always present in 00_common.json.
+const (
+	OutboundDirect = "direct"
+	OutboundBlock  = "block"
+)
+
+// Remote rule-set locations used for the geosite/geoip shorthands.
+const (
+	GeositeURL = "https://raw.githubusercontent.com/SagerNet/sing-geosite/rule-set/geosite-%s.srs"
+	GeoIPURL   = "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/geoip-%s.srs"
+)
+
+// sniffedProtocols are the protocols sing-box's sniffer can report.
+var sniffedProtocols = map[string]struct{}{
+	"http": {}, "tls": {}, "quic": {}, "stun": {}, "dns": {},
+	"bittorrent": {}, "dtls": {}, "ssh": {}, "rdp": {}, "ntp": {},
+}
+
+// Routing controls the route section.
+type Routing struct {
+	// Final is the outbound used when no rule matches; defaults to "direct".
+	Final string `json:"final,omitempty" yaml:"final,omitempty"`
+	// Sniff inspects connections so rules can match the protocol and the
+	// real domain. It is enabled implicitly by protocol rules.
+	Sniff bool `json:"sniff,omitempty" yaml:"sniff,omitempty"`
+	// BlockPrivate rejects connections to private and loopback addresses
+	// before any other rule.
+	BlockPrivate bool `json:"block_private,omitempty" yaml:"block_private,omitempty"`
+	// DownloadDetour is the outbound that fetches remote rule-sets that do
+	// not set their own; defaults to "direct".
+	DownloadDetour string `json:"download_detour,omitempty" yaml:"download_detour,omitempty"`
+	// Rules are evaluated in order after the built-in ones.
+	Rules    []Rule    `json:"rules,omitempty" yaml:"rules,omitempty"`
+	RuleSets []RuleSet `json:"rule_sets,omitempty" yaml:"rule_sets,omitempty"`
+}
+
+// Rule matches connections and sends them to Outbound. Matchers of
+// different kinds must all match; values within one matcher are
+// alternatives. Field names follow sing-box route rules.
+type Rule struct {
+	Protocol      []string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	Domain        []string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	DomainSuffix  []string `json:"domain_suffix,omitempty" yaml:"domain_suffix,omitempty"`
+	DomainKeyword []string `json:"domain_keyword,omitempty" yaml:"domain_keyword,omitempty"`
+	DomainRegex   []string `json:"domain_regex,omitempty" yaml:"domain_regex,omitempty"`
+	IPCIDR        []string `json:"ip_cidr,omitempty" yaml:"ip_cidr,omitempty"`
+	IPIsPrivate   bool     `json:"ip_is_private,omitempty" yaml:"ip_is_private,omitempty"`
+	Port          []int    `json:"port,omitempty" yaml:"port,omitempty"`
+	RuleSet       []string `json:"rule_set,omitempty" yaml:"rule_set,omitempty"`
+	// Geosite and GeoIP name SagerNet rule-sets, e.g. "category-ads-all" or
+	// "cn"; each is added as a remote rule-set tagged geosite-<name> or
+	// geoip-<name> unless a rule-set with that tag is declared.
+	Geosite []string `json:"geosite,omitempty" yaml:"geosite,omitempty"`
+	GeoIP   []string `json:"geoip,omitempty" yaml:"geoip,omitempty"`
+	// Outbound receives matching connections; "block" rejects them.
+	Outbound string `json:"outbound" yaml:"outbound"`
+}
+
+// RuleSet declares a sing-box rule-set.
+type RuleSet struct {
+	Tag string `json:"tag" yaml:"tag"`
+	// Type is "local" or "remote"; inferred from Path or URL when empty.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	// Format is "binary" (.srs, default) or "source" (.json).
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+	URL    string `json:"url,omitempty" yaml:"url,omitempty"`
+	// DownloadDetour overrides Routing.DownloadDetour for this rule-set.
+	DownloadDetour string `json:"download_detour,omitempty" yaml:"download_detour,omitempty"`
+	// UpdateInterval is a duration such as "24h"; sing-box defaults to 1d.
+	UpdateInterval string `json:"update_interval,omitempty" yaml:"update_interval,omitempty"`
+}
+
+func (r Rule) matchers() int {
+	n := len(r.Protocol) + len(r.Domain) + len(r.DomainSuffix) + len(r.DomainKeyword) +
+		len(r.DomainRegex) + len(r.IPCIDR) + len(r.Port) + len(r.RuleSet) + len(r.Geosite) + len(r.GeoIP)
+	if r.IPIsPrivate {
+		n++
+	}
+	return n
+}
+
+// ruleSetTags returns the rule-set tags r refers to, shorthands included.
+func (r Rule) ruleSetTags() []string {
+	tags := append([]string{}, r.RuleSet...)
+	for _, name := range r.Geosite {
+		tags = append(tags, "geosite-"+name)
+	}
+	for _, name := range r.GeoIP {
+		tags = append(tags, "geoip-"+name)
+	}
+	return tags
+}
+
+func (s RuleSet) kind() string {
+	switch {
+	case s.Type != "":
+		return s.Type
+	case s.URL != "":
+		return "remote"
+	default:
+		return "local"
+	}
+}
+
+// ruleSets returns the declared rule-sets followed by those implied by
+// geosite/geoip shorthands in the routing rules and in extra, which carries
+// references from other sections such as DNS rules.
+func (r Routing) ruleSets(extra ...Rule) []RuleSet {
+	sets := append([]RuleSet{}, r.RuleSets...)
+	declared := map[string]struct{}{}
+	for _, s := range sets {
+		declared[s.Tag] = struct{}{}
+	}
+	add := func(tag, format, name string) {
+		if _, ok := declared[tag]; ok {
+			return
+		}
+		declared[tag] = struct{}{}
+		sets = append(sets, RuleSet{Tag: tag, Type: "remote", URL: fmt.Sprintf(format, name)})
+	}
+	for _, rule := range append(append([]Rule{}, r.Rules...), extra...) {
+		for _, name := range rule.Geosite {
+			add("geosite-"+name, GeositeURL, name)
+		}
+		for _, name := range rule.GeoIP {
+			add("geoip-"+name, GeoIPURL, name)
+		}
+	}
+	return sets
+}
+
+func (r Routing) sniff() bool {
+	if r.Sniff {
+		return true
+	}
+	for _, rule := range r.Rules {
+		if len(rule.Protocol) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that rules and rule-sets are complete and that every
+// outbound and rule-set they reference exists. outbounds lists the outbound
+// tags available besides direct and block.
+func (r Routing) Validate(outbounds ...string) error {
+	return r.validate(nil, outbounds)
+}
+
+func (r Routing) validate(extra []Rule, outbounds []string) error {
+	known := map[string]struct{}{OutboundDirect: {}, OutboundBlock: {}}
+	for _, tag := range outbounds {
+		known[tag] = struct{}{}
+	}
+	if r.Final != "" {
+		if _, ok := known[r.Final]; !ok {
+			return fmt.Errorf("route final: unknown outbound %q", r.Final)
+		}
+	}
+	if r.DownloadDetour != "" {
+		if _, ok := known[r.DownloadDetour]; !ok {
+			return fmt.Errorf("route download_detour: unknown outbound %q", r.DownloadDetour)
+		}
+	}
+
+	sets := map[string]struct{}{}
+	for i, s := range r.ruleSets(extra...) {
+		name := s.Tag
+		if name == "" {
+			return fmt.Errorf("rule_sets[%d]: tag is required", i)
+		}
+		if _, ok := sets[name]; ok {
+			return fmt.Errorf("rule-set %s: duplicate tag", name)
+		}
+		sets[name] = struct{}{}
+		switch s.Format {
+		case "", "binary", "source":
+		default:
+			return fmt.Errorf("rule-set %s: unknown format %q", name, s.Format)
+		}
+		switch s.kind() {
+		case "local":
+			if s.Path == "" {
+				return fmt.Errorf("rule-set %s: path is required for a local rule-set", name)
+			}
+			if !filepath.IsAbs(s.Path) {
+				return fmt.Errorf("rule-set %s: path %s must be absolute", name, s.Path)
+			}
+		case "remote":
+			u, err := url.Parse(s.URL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("rule-set %s: invalid url %q", name, s.URL)
+			}
+			if s.DownloadDetour != "" {
+				if _, ok := known[s.DownloadDetour]; !ok {
+					return fmt.Errorf("rule-set %s: unknown download_detour %q", name, s.DownloadDetour)
+				}
+			}
+			if s.UpdateInterval != "" {
+				if _, err := time.ParseDuration(s.UpdateInterval); err != nil {
+					return fmt.Errorf("rule-set %s: invalid update_interval %q", name, s.UpdateInterval)
+				}
+			}
+		default:
+			return fmt.Errorf("rule-set %s: unknown type %q", name, s.Type)
+		}
+	}
+
+	for i, rule := range r.Rules {
+		if rule.matchers() == 0 {
+			return fmt.Errorf("rules[%d]: no match conditions", i)
+		}
+		if rule.Outbound == "" {
+			return fmt.Errorf("rules[%d]: outbound is required", i)
+		}
+		if _, ok := known[rule.Outbound]; !ok {
+			return fmt.Errorf("rules[%d]: unknown outbound %q", i, rule.Outbound)
+		}
+		for _, p := range rule.Protocol {
+			if _, ok := sniffedProtocols[p]; !ok {
+				return fmt.Errorf("rules[%d]: unknown protocol %q", i, p)
+			}
+		}
+		for _, tag := range rule.ruleSetTags() {
+			if _, ok := sets[tag]; !ok {
+				return fmt.Errorf("rules[%d]: unknown rule-set %q", i, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// render returns the route section; extra is passed to ruleSets.
+func (r Routing) render(extra ...Rule) map[string]any {
+	final := r.Final
+	if final == "" {
+		final = OutboundDirect
+	}
+	route := map[string]any{
+		"final": final,
+	}
+	var rules []map[string]any
+	if r.sniff() {
+		rules = append(rules, map[string]any{"action": "sniff"})
+	}
+	if r.BlockPrivate {
+		rules = append(rules, map[string]any{"ip_is_private": true, "action": "reject"})
+	}
+	for _, rule := range r.Rules {
+		rules = append(rules, rule.render())
+	}
+	if len(rules) > 0 {
+		route["rules"] = rules
+	}
+
+	sets := r.ruleSets(extra...)
+	if len(sets) > 0 {
+		detour := r.DownloadDetour
+		if detour == "" {
+			detour = OutboundDirect
+		}
+		rendered := make([]map[string]any, 0, len(sets))
+		for _, s := range sets {
+			format := s.Format
+			if format == "" {
+				format = "binary"
+			}
+			entry := map[string]any{
+				"tag":    s.Tag,
+				"type":   s.kind(),
+				"format": format,
+			}
+			if s.kind() == "local" {
+				entry["path"] = s.Path
+			} else {
+				entry["url"] = s.URL
+				entry["download_detour"] = detour
+				if s.DownloadDetour != "" {
+					entry["download_detour"] = s.DownloadDetour
+				}
+				if s.UpdateInterval != "" {
+					entry["update_interval"] = s.UpdateInterval
+				}
+			}
+			rendered = append(rendered, entry)
+		}
+		route["rule_set"] = rendered
+	}
+	return route
+}
+
+func (r Rule) render() map[string]any {
+	out := map[string]any{}
+	set := func(key string, values []string) {
+		if len(values) > 0 {
+			out[key] = values
+		}
+	}
+	set("protocol", r.Protocol)
+	set("domain", r.Domain)
+	set("domain_suffix", r.DomainSuffix)
+	set("domain_keyword", r.DomainKeyword)
+	set("domain_regex", r.DomainRegex)
+	set("ip_cidr", r.IPCIDR)
+	set("rule_set", r.ruleSetTags())
+	if r.IPIsPrivate {
+		out["ip_is_private"] = true
+	}
+	if len(r.Port) > 0 {
+		out["port"] = r.Port
+	}
+	if r.Outbound == OutboundBlock {
+		out["action"] = "reject"
+	} else {
+		out["outbound"] = r.Outbound
+	}
+	return out
+}
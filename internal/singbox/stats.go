@@ -0,0 +1,92 @@
+package singbox
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Default loopback listeners of the experimental APIs.
+const (
+	DefaultClashAPI = "127.0.0.1:9090"
+	DefaultV2RayAPI = "127.0.0.1:10085"
+)
+
+// Stats enables sing-box's experimental APIs, read by the stats command.
+// The Clash API reports host totals and live connections; the V2Ray API
+// keeps per-inbound and per-user counters but needs a sing-box built with
+// the with_v2ray_api tag.
+type Stats struct {
+	// ClashAPI is the listen address of experimental.clash_api.
+	ClashAPI string `json:"clash_api,omitempty" yaml:"clash_api,omitempty"`
+	// Secret authenticates Clash API requests; deploy generates one when
+	// empty.
+	Secret string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	// V2RayAPI is the listen address of experimental.v2ray_api.
+	V2RayAPI string `json:"v2ray_api,omitempty" yaml:"v2ray_api,omitempty"`
+}
+
+// Counters lists the inbound tags and user names the V2Ray API counts.
+type Counters struct {
+	Inbounds []string
+	Users    []string
+}
+
+func (s Stats) validate() error {
+	for name, address := range map[string]string{"clash_api": s.ClashAPI, "v2ray_api": s.V2RayAPI} {
+		if address == "" {
+			continue
+		}
+		host, _, err := splitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		// The APIs are unauthenticated or guarded by a shared secret only,
+		// so they must not be reachable from outside the host.
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("%s: %s is not a loopback address", name, address)
+		}
+	}
+	return nil
+}
+
+// render returns the experimental section, or nil when no API is enabled.
+func (s Stats) render(counters Counters) map[string]any {
+	out := map[string]any{}
+	if s.ClashAPI != "" {
+		out["clash_api"] = map[string]any{
+			"external_controller": s.ClashAPI,
+			"secret":              s.Secret,
+		}
+	}
+	if s.V2RayAPI != "" {
+		inbounds := sortedUnique(counters.Inbounds)
+		users := sortedUnique(counters.Users)
+		out["v2ray_api"] = map[string]any{
+			"listen": s.V2RayAPI,
+			"stats": map[string]any{
+				"enabled":  true,
+				"inbounds": inbounds,
+				"users":    users,
+			},
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func sortedUnique(values []string) []string {
+	seen := map[string]struct{}{}
+	out := []string{}
+	for _, v := range values {
+		if _, ok := seen[v]; ok || v == "" {
+			continue
+		}
+		seen[v] = struct{}{}
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -4,9 +4,16 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
-	"math"
-	"math/big"
+	"sort"
 	"strings"
+	"time"
+)
+
+// Default WebSocket early data settings, matching the `?ed=2048` hint used by
+// common clients.
+const (
+	DefaultMaxEarlyData        = 2048
+	DefaultEarlyDataHeaderName = "Sec-WebSocket-Protocol"
 )
 
 // InboundSpec describes a single inbound entry rendered through templates.
@@ -23,6 +30,46 @@ type InboundSpec struct {
 	Path       string `json:"path"`
 	Host       string `json:"host"`
 	Transport  string `json:"transport"`
+
+	MaxEarlyData        int    `json:"max_early_data,omitempty"`
+	EarlyDataHeaderName string `json:"early_data_header_name,omitempty"`
+
+	// Users lists the accounts accepted by the inbound. When empty the
+	// inbound has a single anonymous account with UUID.
+	Users []User `json:"users,omitempty"`
+}
+
+// User is an account on an inbound.
+type User struct {
+	Name string `json:"name,omitempty"`
+	UUID string `json:"uuid"`
+	// ExpiresAt marks a credential kept only for a rotation grace period.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Quota is the monthly traffic allowance in bytes; zero is unlimited.
+	Quota int64 `json:"quota,omitempty"`
+	// ValidUntil is when the account stops being served.
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	// Disabled is the reason the account is left out of the inbound.
+	Disabled string `json:"disabled,omitempty"`
+}
+
+// Accounts returns every account of the inbound, including disabled ones.
+func (s InboundSpec) Accounts() []User {
+	if len(s.Users) > 0 {
+		return s.Users
+	}
+	return []User{{UUID: s.UUID}}
+}
+
+// EnabledAccounts returns the users rendered into the inbound's users array.
+func (s InboundSpec) EnabledAccounts() []User {
+	var users []User
+	for _, u := range s.Accounts() {
+		if u.Disabled == "" {
+			users = append(users, u)
+		}
+	}
+	return users
 }
 
 type definition struct {
@@ -80,36 +127,38 @@ func Exists(key string) bool {
 }
 
 // BuildSpec generates a spec pre-populated with default values for the domain.
+// The listen port is left for the caller to allocate.
 func BuildSpec(key, domain string) (InboundSpec, error) {
 	def, ok := definitions[key]
 	if !ok {
 		return InboundSpec{}, fmt.Errorf("unsupported inbound type: %s", key)
 	}
-	uid := newUUID()
+	uid := NewUUID()
 	tag := fmt.Sprintf(def.TagFormat, domain)
-	port, err := randomHighPort()
-	if err != nil {
-		return InboundSpec{}, err
-	}
 	name := fmt.Sprintf("%s-%s", strings.ToUpper(def.Protocol), strings.ToUpper(def.Transport))
 	name = fmt.Sprintf("%s-%s", name, domain)
 
-	return InboundSpec{
-		Key:        key,
-		Tag:        strings.TrimSuffix(tag, ".json"),
-		Name:       name,
-		FileName:   tag,
-		Protocol:   def.Protocol,
-		Listen:     "127.0.0.1",
-		ListenPort: port,
-		UUID:       uid,
-		Path:       "/" + uid,
-		Host:       domain,
-		Transport:  def.Transport,
-	}, nil
+	inbound := InboundSpec{
+		Key:       key,
+		Tag:       strings.TrimSuffix(tag, ".json"),
+		Name:      name,
+		FileName:  tag,
+		Protocol:  def.Protocol,
+		Listen:    "127.0.0.1",
+		UUID:      uid,
+		Path:      "/" + uid,
+		Host:      domain,
+		Transport: def.Transport,
+	}
+	if def.Transport == "ws" {
+		inbound.MaxEarlyData = DefaultMaxEarlyData
+		inbound.EarlyDataHeaderName = DefaultEarlyDataHeaderName
+	}
+	return inbound, nil
 }
 
-func newUUID() string {
+// NewUUID returns a random version 4 UUID.
+func NewUUID() string {
 	var b [16]byte
 	if _, err := rand.Read(b[:]); err != nil {
 		panic(err)
@@ -126,19 +175,19 @@ func newUUID() string {
 	)
 }
 
-func randomHighPort() (int, error) {
-	n, err := rand.Int(rand.Reader, big.NewInt(int64(math.MaxUint16-32768)))
-	if err != nil {
-		return 0, fmt.Errorf("random port: %w", err)
-	}
-	return 32768 + int(n.Int64()), nil
-}
-
-// NormalizeKeys deduplicates inbound keys and preserves order.
+// NormalizeKeys deduplicates inbound keys and preserves order. The key
+// "all" selects every supported key.
 func NormalizeKeys(keys []string) ([]string, error) {
 	if len(keys) == 0 {
 		return SupportedKeys(), nil
 	}
+	for _, key := range keys {
+		if strings.EqualFold(strings.TrimSpace(key), "all") {
+			all := SupportedKeys()
+			sort.Strings(all)
+			return all, nil
+		}
+	}
 	seen := make(map[string]struct{})
 	var normalized []string
 	for _, key := range keys {
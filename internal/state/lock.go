@@ -0,0 +1,76 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned when another process holds the state lock.
+var ErrLocked = errors.New("state file is locked")
+
+// Lock is an advisory lock guarding a state file. It is held on a sibling
+// "<state>.lock" file so that atomic renames of the state itself do not drop
+// the lock.
+type Lock struct {
+	file *os.File
+}
+
+// LockPath returns the lock file used for the state file at path.
+func LockPath(path string) string {
+	return path + ".lock"
+}
+
+// Acquire locks the state file at path. With wait set it blocks until the
+// lock is free; otherwise it fails immediately with an error naming the PID
+// of the current holder.
+func Acquire(path string, wait bool) (*Lock, error) {
+	lockPath := LockPath(path)
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open state lock: %w", err)
+	}
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			if pid := lockHolder(lockPath); pid > 0 {
+				return nil, fmt.Errorf("%w: %s is held by pid %d", ErrLocked, path, pid)
+			}
+			return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+		}
+		return nil, fmt.Errorf("lock state: %w", err)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{file: f}, nil
+}
+
+// Release unlocks and closes the lock file.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return err
+}
+
+func lockHolder(lockPath string) int {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
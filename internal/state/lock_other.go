@@ -0,0 +1,15 @@
+//go:build !unix
+
+package state
+
+import "os"
+
+// Advisory locking is only implemented on unix; elsewhere the lock file
+// merely records the PID.
+func lockFile(f *os.File, wait bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// CurrentVersion is the schema version written by Save.
+const CurrentVersion = 2
+
+// migration upgrades a decoded document by exactly one schema version.
+type migration func(doc map[string]any) error
+
+// migrations maps a source version to the step that upgrades it to the next
+// version. Documents without a schema_version are treated as version 1.
+var migrations = map[int]migration{
+	1: migrateV1ToV2,
+}
+
+// migrateV1ToV2 moves the single-domain layout into the deployments map.
+func migrateV1ToV2(doc map[string]any) error {
+	if _, ok := doc["deployments"]; ok {
+		return nil
+	}
+	domain, _ := doc["domain"].(string)
+	deployments := map[string]any{}
+	if domain != "" {
+		legacy := map[string]any{}
+		for _, field := range []string{"domain", "email", "root_dir", "caddy_file", "subscription_file", "inbounds", "last_updated"} {
+			if v, ok := doc[field]; ok {
+				legacy[field] = v
+			}
+			if field != "last_updated" {
+				delete(doc, field)
+			}
+		}
+		deployments[domain] = legacy
+	}
+	doc["deployments"] = deployments
+	return nil
+}
+
+// documentVersion reports the schema version of a decoded document.
+func documentVersion(doc map[string]any) (int, error) {
+	raw, ok := doc["schema_version"]
+	if !ok {
+		return 1, nil
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("invalid schema_version %v", raw)
+	}
+	v, err := n.Int64()
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid schema_version %v", raw)
+	}
+	return int(v), nil
+}
+
+// upgrade applies migrations in order until doc reaches CurrentVersion and
+// returns the version it started at.
+func upgrade(doc map[string]any) (int, error) {
+	from, err := documentVersion(doc)
+	if err != nil {
+		return 0, err
+	}
+	if from > CurrentVersion {
+		return 0, fmt.Errorf("state schema version %d is newer than supported version %d", from, CurrentVersion)
+	}
+	for v := from; v < CurrentVersion; v++ {
+		step, ok := migrations[v]
+		if !ok {
+			return 0, fmt.Errorf("no migration from state schema version %d", v)
+		}
+		if err := step(doc); err != nil {
+			return 0, fmt.Errorf("migrate state v%d to v%d: %w", v, v+1, err)
+		}
+		doc["schema_version"] = v + 1
+	}
+	return from, nil
+}
+
+func decodeDocument(data []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parse state: %w", err)
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	return doc, nil
+}
+
+// BackupPath returns where the original document of the given version is
+// preserved before it is migrated.
+func BackupPath(path string, version int) string {
+	return fmt.Sprintf("%s.v%d.bak", path, version)
+}
+
+// Check reports the schema version of the file at path without modifying it.
+func Check(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNotFound
+		}
+		return 0, fmt.Errorf("read state: %w", err)
+	}
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return 0, err
+	}
+	return documentVersion(doc)
+}
+
+func writeBackup(path string, version int, data []byte) error {
+	target := BackupPath(path, version)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	if err := os.WriteFile(target, data, FileMode); err != nil {
+		return fmt.Errorf("backup state: %w", err)
+	}
+	return nil
+}
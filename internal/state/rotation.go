@@ -0,0 +1,47 @@
+package state
+
+import (
+	"fmt"
+	"time"
+)
+
+// RotationPolicy schedules automatic credential rotation for a deployment;
+// `rotate --due` acts on it.
+type RotationPolicy struct {
+	Interval Duration `json:"interval"`
+	// Keys limits rotation to these inbounds; empty means all.
+	Keys  []string `json:"keys,omitempty"`
+	UUID  bool     `json:"uuid"`
+	Path  bool     `json:"path"`
+	Port  bool     `json:"port"`
+	Grace Duration `json:"grace,omitempty"`
+	// LastRotated is when credentials were last rotated, by hand or on
+	// schedule, or when the policy was set.
+	LastRotated time.Time `json:"last_rotated"`
+}
+
+// NextRotation returns when the policy next becomes due.
+func (p *RotationPolicy) NextRotation() time.Time {
+	return p.LastRotated.Add(time.Duration(p.Interval))
+}
+
+// Due reports whether rotation is due at now.
+func (p *RotationPolicy) Due(now time.Time) bool {
+	return !now.Before(p.NextRotation())
+}
+
+// Duration is a time.Duration stored in its string form, e.g. "168h0m0s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("parse duration: %w", err)
+	}
+	*d = Duration(v)
+	return nil
+}
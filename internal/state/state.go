@@ -5,11 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
 )
 
-var ErrNotFound = errors.New("state file not found")
+// FileMode is the mode of the state file and its backups, which hold
+// private keys and proxy passwords.
+const FileMode os.FileMode = 0o600
+
+var (
+	ErrNotFound      = errors.New("state file not found")
+	ErrUnknownDomain = errors.New("domain not found in state")
+)
 
 type Inbound struct {
 	Key        string `json:"key"`
@@ -22,9 +33,34 @@ type Inbound struct {
 	Path       string `json:"path"`
 	Host       string `json:"host"`
 	ShareURL   string `json:"share_url"`
+
+	MaxEarlyData        int    `json:"max_early_data,omitempty"`
+	EarlyDataHeaderName string `json:"early_data_header_name,omitempty"`
+
+	Users []User `json:"users,omitempty"`
 }
 
-type State struct {
+// User is an account on an inbound.
+type User struct {
+	Name string `json:"name,omitempty"`
+	UUID string `json:"uuid"`
+	// ExpiresAt is set on a credential replaced by `rotate` that is still
+	// accepted during the grace period; it is pruned by the next deploy or
+	// rotate after this time.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Quota is the traffic allowance per calendar month (UTC) in bytes,
+	// counted by user name across the host; zero is unlimited.
+	Quota int64 `json:"quota,omitempty"`
+	// ValidUntil is the account expiry; `enforce` disables the user after
+	// it.
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	// Disabled is set by `enforce` to the reason ("quota" or "expired") the
+	// user is left out of the rendered inbound.
+	Disabled string `json:"disabled,omitempty"`
+}
+
+// Deployment records everything rendered for a single domain.
+type Deployment struct {
 	Domain           string    `json:"domain"`
 	Email            string    `json:"email"`
 	RootDir          string    `json:"root_dir"`
@@ -32,8 +68,38 @@ type State struct {
 	SubscriptionFile string    `json:"subscription_file"`
 	Inbounds         []Inbound `json:"inbounds"`
 	LastUpdated      time.Time `json:"last_updated"`
+
+	// ProfileName overrides the display name used in share links.
+	ProfileName string `json:"profile_name,omitempty"`
+	// TLSMode is "acme" (default) or "internal" for Caddy's local CA.
+	TLSMode string `json:"tls_mode,omitempty"`
+	// Proxy is "caddy" (default) or "none" when no front proxy is managed.
+	Proxy string `json:"proxy,omitempty"`
+	// SubscriptionFiles maps each rendered format to its file.
+	SubscriptionFiles map[string]string `json:"subscription_files,omitempty"`
+	// Rotation is the automatic rotation policy, if any.
+	Rotation *RotationPolicy `json:"rotation,omitempty"`
 }
 
+type State struct {
+	SchemaVersion int `json:"schema_version"`
+	// Host is the [user@]server the deployments live on when they were
+	// made over SSH; empty for this machine.
+	Host        string                 `json:"host,omitempty"`
+	Deployments map[string]*Deployment `json:"deployments"`
+	// Common holds the host-wide settings rendered into 00_common.json.
+	Common      singbox.Common `json:"common"`
+	LastUpdated time.Time      `json:"last_updated"`
+}
+
+// New returns an empty state document.
+func New() *State {
+	return &State{SchemaVersion: CurrentVersion, Deployments: map[string]*Deployment{}}
+}
+
+// Load reads the state file at path, upgrading older schema versions in
+// memory. The original file is backed up next to it before the first
+// migration; the upgraded document is written by the next Save.
 func Load(path string) (*State, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -42,21 +108,78 @@ func Load(path string) (*State, error) {
 		}
 		return nil, fmt.Errorf("read state: %w", err)
 	}
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	from, err := upgrade(doc)
+	if err != nil {
+		return nil, err
+	}
+	if from < CurrentVersion {
+		if err := writeBackup(path, from, data); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("encode state: %w", err)
+		}
+	}
 	var st State
 	if err := json.Unmarshal(data, &st); err != nil {
 		return nil, fmt.Errorf("parse state: %w", err)
 	}
+	if st.Deployments == nil {
+		st.Deployments = map[string]*Deployment{}
+	}
 	return &st, nil
 }
 
+// Save atomically replaces the state file at path.
 func Save(path string, st *State) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	payload, err := Encode(st)
+	if err != nil {
 		return err
 	}
+	return txn.WriteFile(path, payload, FileMode)
+}
+
+// Encode stamps st with the current schema version and update time and
+// returns its JSON form.
+func Encode(st *State) ([]byte, error) {
+	st.SchemaVersion = CurrentVersion
 	st.LastUpdated = time.Now().UTC()
 	payload, err := json.MarshalIndent(st, "", "  ")
 	if err != nil {
-		return fmt.Errorf("encode state: %w", err)
+		return nil, fmt.Errorf("encode state: %w", err)
+	}
+	return payload, nil
+}
+
+// Domains returns the deployed domains in sorted order.
+func (s *State) Domains() []string {
+	domains := make([]string, 0, len(s.Deployments))
+	for domain := range s.Deployments {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// Select returns the deployment for domain, or every deployment sorted by
+// domain when domain is empty. domain is matched case-insensitively, like
+// the lowercased keys deploy stores.
+func (s *State) Select(domain string) ([]*Deployment, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain != "" {
+		dep, ok := s.Deployments[domain]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownDomain, domain)
+		}
+		return []*Deployment{dep}, nil
+	}
+	selected := make([]*Deployment, 0, len(s.Deployments))
+	for _, d := range s.Domains() {
+		selected = append(selected, s.Deployments[d])
 	}
-	return os.WriteFile(path, payload, 0o644)
+	return selected, nil
 }
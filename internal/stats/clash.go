@@ -0,0 +1,58 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// clashConnections is the part of the Clash API /connections response the
+// stats use.
+type clashConnections struct {
+	UploadTotal   int64 `json:"uploadTotal"`
+	DownloadTotal int64 `json:"downloadTotal"`
+	Connections   []struct {
+		Metadata struct {
+			// Type is "<inbound type>/<inbound tag>".
+			Type string `json:"type"`
+		} `json:"metadata"`
+	} `json:"connections"`
+}
+
+func queryClash(ctx context.Context, address, secret string) (*clashConnections, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+"/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	var conns clashConnections
+	if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		return nil, fmt.Errorf("decode connections: %w", err)
+	}
+	return &conns, nil
+}
+
+// byInbound counts the live connections per inbound tag.
+func (c *clashConnections) byInbound() map[string]int {
+	counts := map[string]int{}
+	for _, conn := range c.Connections {
+		tag := conn.Metadata.Type
+		if _, after, ok := strings.Cut(tag, "/"); ok {
+			tag = after
+		}
+		counts[tag]++
+	}
+	return counts
+}
@@ -0,0 +1,223 @@
+// Package stats reads traffic counters from sing-box's experimental APIs and
+// accumulates them in a stats file, so totals survive sing-box restarts.
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rogeecn/sing-box-deploy/internal/singbox"
+	"github.com/rogeecn/sing-box-deploy/internal/state"
+	"github.com/rogeecn/sing-box-deploy/internal/txn"
+)
+
+// ErrDisabled is returned when neither API is enabled.
+var ErrDisabled = errors.New("no stats API enabled")
+
+// Traffic is a pair of byte counters seen from the client: Upload is what
+// clients sent, Download what they received.
+type Traffic struct {
+	Upload   int64 `json:"upload" yaml:"upload"`
+	Download int64 `json:"download" yaml:"download"`
+}
+
+// Total returns the sum of both directions.
+func (t Traffic) Total() int64 {
+	return t.Upload + t.Download
+}
+
+func (t *Traffic) add(o Traffic) {
+	t.Upload += o.Upload
+	t.Download += o.Download
+}
+
+// File is the persisted cumulative counters.
+type File struct {
+	Since     time.Time          `json:"since"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	Total     Traffic            `json:"total"`
+	Inbounds  map[string]Traffic `json:"inbounds"`
+	Users     map[string]Traffic `json:"users"`
+	// Period is the calendar month (UTC, "2006-01") PeriodUsers covers;
+	// quotas are checked against it.
+	Period      string             `json:"period"`
+	PeriodUsers map[string]Traffic `json:"period_users"`
+	// Clash is the raw Clash API total at the last collection. A lower
+	// reading means sing-box restarted and its counters began again.
+	Clash *Traffic `json:"clash,omitempty"`
+}
+
+// Load reads the stats file at path; a missing file yields empty counters.
+func Load(path string) (*File, error) {
+	f := &File{Inbounds: map[string]Traffic{}, Users: map[string]Traffic{}, PeriodUsers: map[string]Traffic{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, fmt.Errorf("read stats: %w", err)
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("parse stats %s: %w", path, err)
+	}
+	if f.Inbounds == nil {
+		f.Inbounds = map[string]Traffic{}
+	}
+	if f.Users == nil {
+		f.Users = map[string]Traffic{}
+	}
+	if f.PeriodUsers == nil {
+		f.PeriodUsers = map[string]Traffic{}
+	}
+	return f, nil
+}
+
+// PeriodOf returns the quota period containing t.
+func PeriodOf(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// PeriodUsage returns the traffic of user name in period, which is zero once
+// the stats file has moved on to a later period.
+func (f *File) PeriodUsage(name, period string) Traffic {
+	if f.Period != period {
+		return Traffic{}
+	}
+	return f.PeriodUsers[name]
+}
+
+// save writes f with the state file's mode, since it names the same users.
+func (f *File) save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode stats: %w", err)
+	}
+	return txn.WriteFile(path, append(data, '\n'), state.FileMode)
+}
+
+// Names returns the keys of counters in sorted order.
+func Names(counters map[string]Traffic) []string {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func addTo(counters map[string]Traffic, name string, t Traffic) {
+	total := counters[name]
+	total.add(t)
+	counters[name] = total
+}
+
+// Snapshot is the result of a collection.
+type Snapshot struct {
+	*File
+	// Connections counts the live connections per inbound tag; nil when
+	// the Clash API is disabled.
+	Connections map[string]int
+}
+
+// Collector queries the APIs configured in API and folds the readings into
+// the stats file at Path.
+type Collector struct {
+	API  singbox.Stats
+	Path string
+	// Wait blocks on a concurrent collection instead of failing.
+	Wait bool
+	// Timeout bounds each API request; defaults to 5s.
+	Timeout time.Duration
+}
+
+// Collect reads both APIs, adds the new traffic to the stats file and
+// returns the updated totals. V2Ray API counters are reset on every read so
+// each reading is new traffic; Clash API totals are compared with the
+// previous reading. When only the Clash API fails, the V2Ray readings are
+// still saved before its error is returned.
+func (c *Collector) Collect(ctx context.Context) (*Snapshot, error) {
+	if c.API.ClashAPI == "" && c.API.V2RayAPI == "" {
+		return nil, ErrDisabled
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	lock, err := state.Acquire(c.Path, c.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+	f, err := Load(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if f.Since.IsZero() {
+		f.Since = now
+	}
+	if period := PeriodOf(now); f.Period != period {
+		f.Period = period
+		f.PeriodUsers = map[string]Traffic{}
+	}
+	snap := &Snapshot{File: f}
+
+	// The Clash API is read first: V2Ray API counters are reset by the
+	// read, so once they are taken they must reach the stats file.
+	var clashErr error
+	if c.API.ClashAPI != "" {
+		conns, err := queryClash(ctx, c.API.ClashAPI, c.API.Secret)
+		if err != nil {
+			clashErr = fmt.Errorf("query clash api: %w", err)
+		} else {
+			current := Traffic{Upload: conns.UploadTotal, Download: conns.DownloadTotal}
+			delta := current
+			if last := f.Clash; last != nil && current.Upload >= last.Upload && current.Download >= last.Download {
+				delta = Traffic{Upload: current.Upload - last.Upload, Download: current.Download - last.Download}
+			}
+			f.Total.add(delta)
+			f.Clash = &current
+			snap.Connections = conns.byInbound()
+		}
+	}
+	if clashErr != nil && c.API.V2RayAPI == "" {
+		return nil, clashErr
+	}
+	if c.API.V2RayAPI != "" {
+		counters, err := queryV2Ray(ctx, c.API.V2RayAPI, true)
+		if err != nil {
+			return nil, errors.Join(clashErr, fmt.Errorf("query v2ray api: %w", err))
+		}
+		var inbounds Traffic
+		for _, counter := range counters {
+			switch counter.kind {
+			case "inbound":
+				addTo(f.Inbounds, counter.name, counter.traffic)
+				inbounds.add(counter.traffic)
+			case "user":
+				addTo(f.Users, counter.name, counter.traffic)
+				addTo(f.PeriodUsers, counter.name, counter.traffic)
+			}
+		}
+		if c.API.ClashAPI == "" {
+			f.Total.add(inbounds)
+		}
+	}
+
+	f.UpdatedAt = now
+	if err := f.save(c.Path); err != nil {
+		return nil, err
+	}
+	if clashErr != nil {
+		return nil, clashErr
+	}
+	return snap, nil
+}
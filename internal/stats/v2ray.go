@@ -0,0 +1,178 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// queryStatsPath is the gRPC method of sing-box's V2Ray API stats service.
+const queryStatsPath = "/experimental.v2rayapi.StatsService/QueryStats"
+
+// counter is one V2Ray API counter such as
+// "user>>>alice>>>traffic>>>uplink", folded per name.
+type counter struct {
+	kind    string
+	name    string
+	traffic Traffic
+}
+
+// queryV2Ray calls QueryStats over plaintext HTTP/2. The request and
+// response messages are small enough to encode by hand, which avoids
+// pulling in a gRPC stack for one call.
+func queryV2Ray(ctx context.Context, address string, reset bool) ([]counter, error) {
+	// QueryStatsRequest{pattern = 1: "", reset = 2}
+	var msg []byte
+	if reset {
+		msg = []byte{0x10, 0x01}
+	}
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+address+queryStatsPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "" && status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return nil, fmt.Errorf("grpc status %s: %s", status, message)
+	}
+	if len(payload) < 5 {
+		return nil, errors.New("short grpc response")
+	}
+	size := binary.BigEndian.Uint32(payload[1:5])
+	if payload[0] != 0 || int(size) > len(payload)-5 {
+		return nil, errors.New("malformed grpc response")
+	}
+	return decodeQueryStatsResponse(payload[5 : 5+size])
+}
+
+// decodeQueryStatsResponse parses QueryStatsResponse{repeated Stat stat = 1}
+// with Stat{string name = 1; int64 value = 2}.
+func decodeQueryStatsResponse(data []byte) ([]counter, error) {
+	folded := map[string]*counter{}
+	var order []string
+	err := walkProto(data, func(field int, value []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		var name string
+		var v int64
+		err := walkProto(value, func(field int, value []byte, n uint64) error {
+			switch field {
+			case 1:
+				name = string(value)
+			case 2:
+				v = int64(n)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(name, ">>>")
+		if len(parts) != 4 || parts[2] != "traffic" {
+			return nil
+		}
+		key := parts[0] + ">>>" + parts[1]
+		c, ok := folded[key]
+		if !ok {
+			c = &counter{kind: parts[0], name: parts[1]}
+			folded[key] = c
+			order = append(order, key)
+		}
+		switch parts[3] {
+		case "uplink":
+			c.traffic.Upload += v
+		case "downlink":
+			c.traffic.Download += v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode QueryStatsResponse: %w", err)
+	}
+	counters := make([]counter, 0, len(order))
+	for _, key := range order {
+		counters = append(counters, *folded[key])
+	}
+	return counters, nil
+}
+
+// walkProto calls fn for every field of a protobuf message, passing the
+// bytes of length-delimited fields and the value of varint fields.
+func walkProto(data []byte, fn func(field int, value []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+			if err := fn(field, nil, v); err != nil {
+				return err
+			}
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errors.New("invalid length")
+			}
+			value := data[n : n+int(size)]
+			data = data[n+int(size):]
+			if err := fn(field, value, 0); err != nil {
+				return err
+			}
+		case 1:
+			if len(data) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			data = data[8:]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/fs"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -15,14 +16,17 @@ import (
 type Data struct {
 	Domain      string
 	Email       string
+	TLSMode     string
 	Inbounds    map[string]spec.InboundSpec
 	TLSKeyPath  string
 	TLSCertPath string
 }
 
 var (
-	inboundTemplates = map[string]*template.Template{}
-	caddyTemplate    *template.Template
+	inboundTemplates  = map[string]*template.Template{}
+	caddyTemplate     *template.Template
+	systemdTemplates  *template.Template
+	logrotateTemplate *template.Template
 )
 
 func init() {
@@ -32,6 +36,14 @@ func init() {
 	if err := loadCaddyTemplate(); err != nil {
 		panic(err)
 	}
+	if err := loadSystemdTemplates(); err != nil {
+		panic(err)
+	}
+	tpl, err := template.ParseFS(tmpl.Files, "logrotate/sing-box.tmpl")
+	if err != nil {
+		panic(err)
+	}
+	logrotateTemplate = tpl
 }
 
 func loadInboundTemplates() error {
@@ -60,6 +72,15 @@ func loadCaddyTemplate() error {
 	return nil
 }
 
+func loadSystemdTemplates() error {
+	tpl, err := template.ParseFS(tmpl.Files, "systemd/*.tmpl")
+	if err != nil {
+		return err
+	}
+	systemdTemplates = tpl
+	return nil
+}
+
 // RenderInbounds renders template files for the provided data set.
 func RenderInbounds(data Data) (map[string][]byte, error) {
 	outputs := make(map[string][]byte, len(data.Inbounds))
@@ -77,11 +98,34 @@ func RenderInbounds(data Data) (map[string][]byte, error) {
 	return outputs, nil
 }
 
-// RenderCaddy renders the Caddyfile template.
-func RenderCaddy(data Data) ([]byte, error) {
+// RenderCaddy renders the Caddyfile template with one site block per entry.
+func RenderCaddy(sites []Data) ([]byte, error) {
+	sorted := append([]Data(nil), sites...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Domain < sorted[j].Domain
+	})
 	var buf bytes.Buffer
-	if err := caddyTemplate.Execute(&buf, data); err != nil {
+	if err := caddyTemplate.Execute(&buf, struct{ Sites []Data }{sorted}); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
+
+// RenderSystemd renders the systemd unit template with the given file name
+// (without the .tmpl suffix), e.g. "sing-box.service".
+func RenderSystemd(name string, data any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := systemdTemplates.ExecuteTemplate(&buf, name+".tmpl", data); err != nil {
+		return nil, fmt.Errorf("execute template %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderLogrotate renders the logrotate snippet for the sing-box log file.
+func RenderLogrotate(data any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := logrotateTemplate.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("execute logrotate template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
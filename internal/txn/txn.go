@@ -0,0 +1,181 @@
+// Package txn stages file writes next to their targets and commits them
+// together, so an interrupted deploy never leaves truncated files behind.
+package txn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rogeecn/sing-box-deploy/internal/fsys"
+)
+
+type staged struct {
+	temp   string
+	target string
+}
+
+// Tx collects pending writes and removals. The zero value is ready to use
+// and works on the local filesystem.
+type Tx struct {
+	fs      fsys.FS
+	writes  []staged
+	removes []string
+	done    bool
+}
+
+// New returns an empty transaction on the local filesystem.
+func New() *Tx {
+	return &Tx{}
+}
+
+// NewOn returns an empty transaction on target.
+func NewOn(target fsys.FS) *Tx {
+	return &Tx{fs: target}
+}
+
+func (t *Tx) target() fsys.FS {
+	if t.fs == nil {
+		return fsys.Local{}
+	}
+	return t.fs
+}
+
+// MkdirAll creates a directory on the transaction's filesystem right away.
+func (t *Tx) MkdirAll(path string, perm os.FileMode) error {
+	return t.target().MkdirAll(path, perm)
+}
+
+// WriteFile writes data to a temporary file in the target directory and
+// fsyncs it. The target is only replaced on Commit.
+func (t *Tx) WriteFile(path string, data []byte, perm os.FileMode) error {
+	if t.done {
+		return errors.New("transaction already finished")
+	}
+	dir := filepath.Dir(path)
+	if err := t.target().MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	temp, err := writeTemp(t.target(), dir, filepath.Base(path), data, perm)
+	if err != nil {
+		return fmt.Errorf("stage %s: %w", path, err)
+	}
+	for i := range t.writes {
+		if t.writes[i].target == path {
+			t.target().Remove(t.writes[i].temp)
+			t.writes[i].temp = temp
+			return nil
+		}
+	}
+	t.writes = append(t.writes, staged{temp: temp, target: path})
+	return nil
+}
+
+// Remove schedules path for deletion on Commit.
+func (t *Tx) Remove(path string) {
+	t.removes = append(t.removes, path)
+}
+
+// Entry describes a staged write.
+type Entry struct {
+	Target string
+	Temp   string
+}
+
+// Staged returns the pending writes in the order they were added.
+func (t *Tx) Staged() []Entry {
+	entries := make([]Entry, 0, len(t.writes))
+	for _, w := range t.writes {
+		entries = append(entries, Entry{Target: w.target, Temp: w.temp})
+	}
+	return entries
+}
+
+// Removals returns the paths scheduled for deletion.
+func (t *Tx) Removals() []string {
+	return append([]string(nil), t.removes...)
+}
+
+// Commit renames every staged file into place, syncs the affected
+// directories and then performs scheduled removals.
+func (t *Tx) Commit() error {
+	if t.done {
+		return errors.New("transaction already finished")
+	}
+	t.done = true
+	fs := t.target()
+	dirs := map[string]struct{}{}
+	for i, w := range t.writes {
+		if err := fs.Rename(w.temp, w.target); err != nil {
+			for _, rest := range t.writes[i:] {
+				fs.Remove(rest.temp)
+			}
+			return fmt.Errorf("commit %s: %w", w.target, err)
+		}
+		dirs[filepath.Dir(w.target)] = struct{}{}
+	}
+	for _, path := range t.removes {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	for dir := range dirs {
+		fs.SyncDir(dir)
+	}
+	return nil
+}
+
+// Rollback discards staged files. It is safe to call after Commit.
+func (t *Tx) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	for _, w := range t.writes {
+		t.target().Remove(w.temp)
+	}
+}
+
+// WriteFile atomically replaces a single local file.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteFileOn(fsys.Local{}, path, data, perm)
+}
+
+// WriteFileOn atomically replaces a single file on target.
+func WriteFileOn(target fsys.FS, path string, data []byte, perm os.FileMode) error {
+	tx := NewOn(target)
+	if err := tx.WriteFile(path, data, perm); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeTemp(fs fsys.FS, dir, base string, data []byte, perm os.FileMode) (string, error) {
+	f, err := fs.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	fail := func(err error) (string, error) {
+		f.Close()
+		fs.Remove(name)
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		fs.Remove(name)
+		return "", err
+	}
+	return name, nil
+}